@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// labels docker-compose applies to each container it creates
+const (
+	ComposeProjectLabel = "com.docker.compose.project"
+	ComposeServiceLabel = "com.docker.compose.service"
+)
+
+// the subset of a docker-compose file whalewatcher reads
+type composeFile struct {
+	Name     string                    `yaml:"name"`
+	Services map[string]composeService `yaml:"services"`
+}
+
+type composeService struct {
+	ContainerName string     `yaml:"container_name"`
+	Whalewatcher  *Container `yaml:"x-whalewatcher"`
+}
+
+// characters docker-compose strips from project names
+var invalidProjectChars = regexp.MustCompile(`[^-_a-z0-9]`)
+
+// load targets from the x-whalewatcher extension on each service in a
+// docker-compose file, i.e.
+//
+//	services:
+//	  mysql:
+//	    image: percona:5.7.21
+//	    x-whalewatcher:
+//	      pattern: 'mysqld: ready for connections'
+//	      max_wait_millis: 90000
+//
+// a service with a container_name is targeted by that name. otherwise the target
+// is keyed by the service name, and selects the service's container by its
+// compose labels rather than its generated name, which differs between compose
+// v1 (<project>_<service>_1) and v2 (<project>-<service>-1). project overrides
+// the compose project name, as with docker-compose -p. without it, the file's
+// top level name or COMPOSE_PROJECT_NAME is used, and failing those the
+// service is selected in any project
+func FromCompose(pathToFile, project string) (*Config, error) {
+	conf := &Config{Containers: map[string]Container{}}
+
+	raw, err := ioutil.ReadFile(pathToFile)
+	if err != nil {
+		return conf, fmt.Errorf("failed to read expected compose file at path %q", pathToFile)
+	}
+
+	compose := composeFile{}
+	if err := yaml.Unmarshal(raw, &compose); err != nil {
+		return conf, fmt.Errorf("failed to parse compose file %q: %s", pathToFile, err)
+	}
+
+	if len(project) == 0 {
+		project = composeProject(compose.Name)
+	}
+
+	for service, spec := range compose.Services {
+		if spec.Whalewatcher == nil {
+			continue
+		}
+
+		target := *spec.Whalewatcher
+		if len(spec.ContainerName) > 0 {
+			conf.Containers[spec.ContainerName] = target
+			continue
+		}
+
+		target.Service = service
+		if len(target.Project) == 0 {
+			target.Project = project
+		}
+		conf.Containers[service] = target
+	}
+
+	return conf, nil
+}
+
+// resolve the project name from the file's top level name or COMPOSE_PROJECT_NAME,
+// normalized as docker-compose does. unlike docker-compose, the name of the
+// directory holding the file isn't used: whalewatcher usually reads the file
+// mounted into its own container, where that directory isn't the project's
+func composeProject(name string) string {
+	if len(name) == 0 {
+		name = os.Getenv("COMPOSE_PROJECT_NAME")
+	}
+
+	return invalidProjectChars.ReplaceAllString(strings.ToLower(name), "")
+}
+
+// add the other config's targets, replacing any of the same name
+func (c *Config) Merge(other *Config) {
+	if c.Containers == nil {
+		c.Containers = map[string]Container{}
+	}
+	for name, target := range other.Containers {
+		c.Containers[name] = target
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeComposeFile(t *testing.T, project, body string) (string, func()) {
+	dir, err := ioutil.TempDir("", "wwcompose")
+	require.NoError(t, err)
+
+	projectDir := filepath.Join(dir, project)
+	require.NoError(t, os.Mkdir(projectDir, 0777))
+
+	path := filepath.Join(projectDir, "docker-compose.yml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(body), 0666))
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestConfigFromCompose(t *testing.T) {
+	yamlBody := `
+version: '3'
+services:
+  mysql:
+    image: percona:5.7.21
+    container_name: demo-mysql
+    x-whalewatcher:
+      pattern: 'mysqld: ready for connections'
+      max_wait_millis: 90000
+  redis:
+    image: redis:5.0.7
+    x-whalewatcher:
+      since: 24h
+      patterns:
+        - 'Ready to accept connections'
+  alpine:
+    image: alpine:latest
+`
+	path, cleanup := writeComposeFile(t, "My.App", yamlBody)
+	defer cleanup()
+
+	conf, err := FromCompose(path, "")
+	require.NoError(t, err)
+	require.Len(t, conf.Containers, 2)
+
+	mysql, found := conf.Containers["demo-mysql"]
+	require.True(t, found)
+	require.Equal(t, "mysqld: ready for connections", mysql.Pattern)
+	require.Equal(t, 90000, mysql.MaxWaitMillis)
+
+	// selected by service. the directory holding the file says nothing about the
+	// project when it's mounted into whalewatcher's container, so any project matches
+	redis, found := conf.Containers["redis"]
+	require.True(t, found)
+	require.Equal(t, "24h", redis.Since)
+	require.Equal(t, []string{"Ready to accept connections"}, redis.Patterns)
+	require.Equal(t, "redis", redis.Service)
+	require.Empty(t, redis.Project)
+
+	conf, err = FromCompose(path, "other")
+	require.NoError(t, err)
+	require.Equal(t, "other", conf.Containers["redis"].Project)
+}
+
+func TestConfigFromComposeProjectName(t *testing.T) {
+	yamlBody := `
+name: demo
+services:
+  redis:
+    x-whalewatcher:
+      pattern: 'Ready'
+`
+	path, cleanup := writeComposeFile(t, "checkout", yamlBody)
+	defer cleanup()
+
+	conf, err := FromCompose(path, "")
+	require.NoError(t, err)
+	require.Equal(t, "demo", conf.Containers["redis"].Project)
+
+	os.Setenv("COMPOSE_PROJECT_NAME", "Other.App")
+	defer os.Unsetenv("COMPOSE_PROJECT_NAME")
+	path, cleanup = writeComposeFile(t, "checkout2", "services:\n  redis:\n    x-whalewatcher:\n      pattern: 'Ready'\n")
+	defer cleanup()
+
+	conf, err = FromCompose(path, "")
+	require.NoError(t, err)
+	require.Equal(t, "otherapp", conf.Containers["redis"].Project)
+}
+
+func TestConfigMerge(t *testing.T) {
+	conf := &Config{Containers: map[string]Container{
+		"foo": {Pattern: "compose"},
+		"bar": {Pattern: "compose"},
+	}}
+	conf.Merge(&Config{Containers: map[string]Container{
+		"bar": {Pattern: "file"},
+		"baz": {Pattern: "file"},
+	}})
+
+	require.Equal(t, map[string]Container{
+		"foo": {Pattern: "compose"},
+		"bar": {Pattern: "file"},
+		"baz": {Pattern: "file"},
+	}, conf.Containers)
+}
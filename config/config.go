@@ -4,6 +4,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -11,6 +16,9 @@ import (
 // The config file model - a mapping of container names to monitoring configuration
 type Config struct {
 	Containers map[string]Container `yaml:"containers"`
+
+	// named sets of targets, whose members may be targets or other groups
+	Groups map[string][]string `yaml:"groups"`
 }
 
 // The configuration for a single app whalewatcher should monitor
@@ -21,6 +29,10 @@ type Container struct {
 	// backwards compatible attribute for specifying more than one pattern
 	Patterns []string `yaml:"patterns"`
 
+	// optional: regex patterns to match in log indicating a fatal error;
+	// a match marks the target failed without awaiting the max wait
+	FailurePatterns []string `yaml:"failure_patterns"`
+
 	// optional: time to tail the target container's log
 	// (without errors) before marking the container ready
 	MaxWaitMillis int `yaml:"max_wait_millis"`
@@ -28,6 +40,252 @@ type Container struct {
 	// optional: only log lines more recently produced than this will be
 	// fetched during tailing. accepts a time.Duration string
 	Since string `yaml:"since"`
+
+	// optional: outcome published when max wait elapses without a match,
+	// one of "ready", "error" or "timed_out". overrides global --on-timeout
+	OnTimeout string `yaml:"on_timeout"`
+
+	// optional: "once" (the default) stops monitoring at the first match or
+	// error. "continuous" keeps following the target across container restarts
+	Mode string `yaml:"mode"`
+
+	// optional: select the target container by its compose service (and
+	// project) labels rather than by container name
+	Service string `yaml:"service"`
+	Project string `yaml:"project"`
+
+	// optional: select the target containers by a glob on their names
+	Match string `yaml:"match"`
+
+	// optional: for targets selected by service or match, whether "all" (the
+	// default) or "any" of the replicas must be ready, or the minimum number
+	// that must be ready, which overrides quorum if set
+	Quorum   string `yaml:"quorum"`
+	MinReady int    `yaml:"min_ready"`
+
+	// optional: targets that must also be ready before this one is
+	// reported ready. if any of them fails, so does this target
+	DependsOn []string `yaml:"depends_on"`
+
+	// optional: a TCP connect check run against the target while it starts
+	TCPProbe *TCPProbe `yaml:"tcp_probe"`
+
+	// optional: an HTTP request whose response is checked while the target starts
+	HTTPProbe *HTTPProbe `yaml:"http_probe"`
+
+	// optional: a command run inside the target container while it starts
+	ExecProbe *ExecProbe `yaml:"exec_probe"`
+
+	// optional: a file inside the target container signaling it's ready
+	FileProbe *FileProbe `yaml:"file_probe"`
+
+	// optional: treat the container's own HEALTHCHECK status as a probe.
+	// overrides global --use-healthcheck
+	UseHealthcheck *bool `yaml:"use_healthcheck"`
+
+	// set when use_healthcheck came from the global default, not the target
+	healthcheckDefaulted bool
+
+	// optional: whether readiness requires a log pattern match ("logs", the
+	// default), the target's probes passing ("probe"), "all" or "any" of these
+	ReadyWhen string `yaml:"ready_when"`
+}
+
+// report whether the target may select several containers, each a replica
+// monitored independently and aggregated by the target's quorum
+func (c Container) Replicated() bool {
+	return len(c.Service) > 0 || len(c.Match) > 0
+}
+
+// monitoring modes for a target
+const (
+	ModeOnce       = "once"
+	ModeContinuous = "continuous"
+)
+
+// quorum policies for replicated targets
+const (
+	QuorumAll = "all"
+	QuorumAny = "any"
+)
+
+// policies for the status published when a target's max wait elapses without a match
+const (
+	OnTimeoutReady    = "ready"
+	OnTimeoutError    = "error"
+	OnTimeoutTimedOut = "timed_out"
+)
+
+// global settings applied to each target that doesn't override them
+type Defaults struct {
+	OnTimeout string
+
+	// compose project of targets selected by service
+	Project string
+
+	// whether targets use their container's HEALTHCHECK status
+	UseHealthcheck bool
+}
+
+// fill in unset per-target options from the global defaults
+func (c *Config) ApplyDefaults(defaults Defaults) {
+	for name, target := range c.Containers {
+		if len(target.OnTimeout) == 0 {
+			target.OnTimeout = defaults.OnTimeout
+		}
+		if len(target.Service) > 0 && len(target.Project) == 0 {
+			target.Project = defaults.Project
+		}
+		if target.UseHealthcheck == nil && defaults.UseHealthcheck {
+			use := true
+			target.UseHealthcheck = &use
+			target.healthcheckDefaulted = true
+		}
+		c.Containers[name] = target
+	}
+}
+
+// report whether policy is a recognized on_timeout value
+func ValidOnTimeout(policy string) bool {
+	switch policy {
+	case OnTimeoutReady, OnTimeoutError, OnTimeoutTimedOut:
+		return true
+	}
+	return false
+}
+
+// check every target's settings, so a bad config is rejected as a whole
+func (c *Config) Validate() error {
+	names := make([]string, 0, len(c.Containers))
+	for name := range c.Containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := c.Containers[name].Validate(); err != nil {
+			return fmt.Errorf("invalid config for container %q: %s", name, err)
+		}
+
+		for _, dep := range c.Containers[name].DependsOn {
+			if _, ok := c.Containers[dep]; !ok {
+				return fmt.Errorf("invalid config for container %q: depends on unknown target %q", name, dep)
+			}
+		}
+	}
+
+	if cycle := findCycle(names, c.Dependencies()); cycle != nil {
+		return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	return c.validateGroups()
+}
+
+// find a cycle in the graph described by edges, searching from each of the
+// names in order. returns the first cycle found as a path, or nil
+func findCycle(names []string, edges map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	path := []string{}
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			for i, step := range path {
+				if step == name {
+					return append(append([]string{}, path[i:]...), name)
+				}
+			}
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, next := range edges[name] {
+			if cycle := visit(next); cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+
+		return nil
+	}
+
+	for _, name := range names {
+		if cycle := visit(name); cycle != nil {
+			return cycle
+		}
+	}
+
+	return nil
+}
+
+// the depends_on graph, by target name
+func (c *Config) Dependencies() map[string][]string {
+	out := map[string][]string{}
+	for name, target := range c.Containers {
+		if len(target.DependsOn) > 0 {
+			out[name] = append([]string(nil), target.DependsOn...)
+		}
+	}
+	return out
+}
+
+// check a single target's settings
+func (c Container) Validate() error {
+	if len(c.Pattern) == 0 && len(c.Patterns) == 0 && c.Readiness() != ReadyWhenProbe {
+		return fmt.Errorf("at least one regex pattern is required")
+	}
+
+	patterns := append([]string{c.Pattern}, c.Patterns...)
+	for _, pattern := range append(patterns, c.FailurePatterns...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid regex pattern %q: %s", pattern, err)
+		}
+	}
+
+	if len(c.Since) > 0 {
+		if _, err := time.ParseDuration(c.Since); err != nil {
+			return fmt.Errorf("invalid since duration %q: %s", c.Since, err)
+		}
+	}
+
+	if len(c.OnTimeout) > 0 && !ValidOnTimeout(c.OnTimeout) {
+		return fmt.Errorf("invalid on_timeout policy %q", c.OnTimeout)
+	}
+
+	if len(c.Mode) > 0 && c.Mode != ModeOnce && c.Mode != ModeContinuous {
+		return fmt.Errorf("invalid mode %q", c.Mode)
+	}
+
+	if len(c.Project) > 0 && len(c.Service) == 0 {
+		return fmt.Errorf("project %q requires a service", c.Project)
+	}
+
+	if _, err := path.Match(c.Match, ""); err != nil {
+		return fmt.Errorf("invalid match glob %q: %s", c.Match, err)
+	}
+
+	if len(c.Quorum) > 0 && c.Quorum != QuorumAll && c.Quorum != QuorumAny {
+		return fmt.Errorf("invalid quorum %q", c.Quorum)
+	}
+
+	if c.MinReady < 0 {
+		return fmt.Errorf("invalid min_ready %d", c.MinReady)
+	}
+
+	if (len(c.Quorum) > 0 || c.MinReady > 0) && !c.Replicated() {
+		return fmt.Errorf("quorum and min_ready require a service or match")
+	}
+
+	return c.validateProbes()
 }
 
 // load config YAML from a file mounted into whalewatcher's container
@@ -21,6 +21,8 @@ containers:
     patterns:
      - '^start \d+'
      - '(INFO|DEBUG) ready'
+    failure_patterns:
+     - 'OutOfMemoryError'
 `
 
 	os.Setenv(varName, yamlBody)
@@ -38,6 +40,7 @@ containers:
 	require.Len(t, bar.Patterns, 2)
 	require.Equal(t, "^start \\d+", bar.Patterns[0])
 	require.Equal(t, "(INFO|DEBUG) ready", bar.Patterns[1])
+	require.Equal(t, []string{"OutOfMemoryError"}, bar.FailurePatterns)
 
 	_, found = conf.Containers["does_not_exist"]
 	require.False(t, found)
@@ -83,3 +86,117 @@ containers:
 	_, found = conf.Containers["does_not_exist"]
 	require.False(t, found)
 }
+
+func TestConfigApplyDefaults(t *testing.T) {
+	varName := "WHALEWATCHER_CONFIG"
+	yamlBody := `
+containers:
+  foo:
+    pattern: 'ABC 123'
+  bar:
+    pattern: 'DEF 234'
+    on_timeout: error
+  baz:
+    pattern: 'GHI 345'
+    service: baz
+  qux:
+    pattern: 'JKL 456'
+    service: qux
+    project: other
+`
+
+	os.Setenv(varName, yamlBody)
+	conf, err := FromVar(varName)
+	require.NoError(t, err)
+
+	conf.ApplyDefaults(Defaults{OnTimeout: OnTimeoutTimedOut, Project: "demo"})
+	require.Equal(t, OnTimeoutTimedOut, conf.Containers["foo"].OnTimeout)
+	require.Equal(t, OnTimeoutError, conf.Containers["bar"].OnTimeout)
+
+	// only targets selected by service are placed in the default project
+	require.Empty(t, conf.Containers["foo"].Project)
+	require.Equal(t, "demo", conf.Containers["baz"].Project)
+	require.Equal(t, "other", conf.Containers["qux"].Project)
+
+	require.True(t, ValidOnTimeout(OnTimeoutReady))
+	require.False(t, ValidOnTimeout("nope"))
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := &Config{Containers: map[string]Container{
+		"foo": {Pattern: "ABC 123", Since: "12h", OnTimeout: OnTimeoutError, Mode: ModeContinuous},
+		"bar": {Patterns: []string{"DEF", "XYZ"}, FailurePatterns: []string{"FATAL"}},
+		"baz": {Pattern: "GHI", Service: "baz", Quorum: QuorumAny},
+		"qux": {Pattern: "JKL", Match: "demo_worker_*", MinReady: 2},
+	}}
+	require.NoError(t, valid.Validate())
+
+	for _, target := range []Container{
+		{},
+		{Pattern: "(unclosed"},
+		{Pattern: "ok", FailurePatterns: []string{"[bad"}},
+		{Pattern: "ok", Since: "yesterday"},
+		{Pattern: "ok", OnTimeout: "shrug"},
+		{Pattern: "ok", Mode: "sometimes"},
+		{Pattern: "ok", Project: "demo"},
+		{Pattern: "ok", Match: "[unclosed"},
+		{Pattern: "ok", Service: "foo", Quorum: "most"},
+		{Pattern: "ok", Service: "foo", MinReady: -1},
+		{Pattern: "ok", Quorum: QuorumAny},
+	} {
+		conf := &Config{Containers: map[string]Container{"foo": target}}
+		err := conf.Validate()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), `"foo"`)
+	}
+}
+
+func TestConfigDependsOn(t *testing.T) {
+	varName := "WHALEWATCHER_CONFIG"
+	yamlBody := `
+containers:
+  demo-zookeeper:
+    pattern: 'Established session'
+  demo-kafka:
+    pattern: 'Cached leader info'
+    depends_on: [demo-zookeeper]
+  demo-app:
+    pattern: 'started'
+    depends_on:
+      - demo-kafka
+      - demo-zookeeper
+`
+
+	os.Setenv(varName, yamlBody)
+	conf, err := FromVar(varName)
+	require.NoError(t, err)
+	require.NoError(t, conf.Validate())
+	require.Equal(t, map[string][]string{
+		"demo-kafka": {"demo-zookeeper"},
+		"demo-app":   {"demo-kafka", "demo-zookeeper"},
+	}, conf.Dependencies())
+}
+
+func TestConfigDependsOnInvalid(t *testing.T) {
+	unknown := &Config{Containers: map[string]Container{
+		"foo": {Pattern: "foo", DependsOn: []string{"bar"}},
+	}}
+	err := unknown.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown target "bar"`)
+
+	cyclic := &Config{Containers: map[string]Container{
+		"a": {Pattern: "a", DependsOn: []string{"b"}},
+		"b": {Pattern: "b", DependsOn: []string{"c"}},
+		"c": {Pattern: "c", DependsOn: []string{"a"}},
+		"d": {Pattern: "d", DependsOn: []string{"a"}},
+	}}
+	err = cyclic.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dependency cycle: a -> b -> c -> a")
+
+	self := &Config{Containers: map[string]Container{
+		"a": {Pattern: "a", DependsOn: []string{"a"}},
+	}}
+	require.Error(t, self.Validate())
+}
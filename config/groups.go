@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// check each group's members are known targets or groups, and that no
+// group contains itself
+func (c *Config) validateGroups() error {
+	names := make([]string, 0, len(c.Groups))
+	for name := range c.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := c.Containers[name]; ok {
+			return fmt.Errorf("invalid group %q: a target has the same name", name)
+		}
+		if len(c.Groups[name]) == 0 {
+			return fmt.Errorf("invalid group %q: no members", name)
+		}
+
+		for _, member := range c.Groups[name] {
+			_, isTarget := c.Containers[member]
+			_, isGroup := c.Groups[member]
+			if !isTarget && !isGroup {
+				return fmt.Errorf("invalid group %q: unknown member %q", name, member)
+			}
+		}
+	}
+
+	if cycle := findCycle(names, c.Groups); cycle != nil {
+		return fmt.Errorf("group cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	return nil
+}
+
+// resolve the named groups to the sorted set of targets they contain,
+// including those in any nested groups
+func ExpandGroups(groups map[string][]string, names []string) ([]string, error) {
+	found := map[string]bool{}
+
+	var expand func(name string) error
+	expand = func(name string) error {
+		members, ok := groups[name]
+		if !ok {
+			return fmt.Errorf("requested group (%s) is not defined", name)
+		}
+
+		for _, member := range members {
+			if _, nested := groups[member]; nested {
+				if err := expand(member); err != nil {
+					return err
+				}
+				continue
+			}
+			found[member] = true
+		}
+		return nil
+	}
+
+	for _, name := range names {
+		if err := expand(name); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]string, 0, len(found))
+	for name := range found {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+
+	return out, nil
+}
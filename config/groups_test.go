@@ -0,0 +1,65 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigGroups(t *testing.T) {
+	varName := "WHALEWATCHER_CONFIG"
+	yamlBody := `
+containers:
+  demo-zookeeper:
+    pattern: 'Established session'
+  demo-kafka:
+    pattern: 'Cached leader info'
+  demo-mysql:
+    pattern: 'ready for connections'
+groups:
+  streaming: [demo-zookeeper, demo-kafka]
+  backend:
+    - streaming
+    - demo-mysql
+    - demo-kafka
+`
+
+	os.Setenv(varName, yamlBody)
+	conf, err := FromVar(varName)
+	require.NoError(t, err)
+	require.NoError(t, conf.Validate())
+
+	members, err := ExpandGroups(conf.Groups, []string{"backend"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"demo-kafka", "demo-mysql", "demo-zookeeper"}, members)
+
+	members, err = ExpandGroups(conf.Groups, []string{"streaming"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"demo-kafka", "demo-zookeeper"}, members)
+
+	_, err = ExpandGroups(conf.Groups, []string{"streaming", "frontend"})
+	require.EqualError(t, err, "requested group (frontend) is not defined")
+}
+
+func TestConfigGroupsInvalid(t *testing.T) {
+	targets := map[string]Container{
+		"foo": {Pattern: "foo"},
+		"bar": {Pattern: "bar"},
+	}
+
+	for _, tc := range []struct {
+		groups map[string][]string
+		err    string
+	}{
+		{map[string][]string{"a": {"foo", "baz"}}, `unknown member "baz"`},
+		{map[string][]string{"a": {}}, "no members"},
+		{map[string][]string{"foo": {"bar"}}, "a target has the same name"},
+		{map[string][]string{"a": {"b"}, "b": {"foo", "a"}}, "group cycle: a -> b -> a"},
+	} {
+		conf := &Config{Containers: targets, Groups: tc.groups}
+		err := conf.Validate()
+		require.Error(t, err)
+		require.Contains(t, err.Error(), tc.err)
+	}
+}
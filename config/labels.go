@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Docker labels carrying a container's own monitoring config are prefixed with this
+const LabelPrefix = "whalewatcher."
+
+// report whether any whalewatcher monitoring labels are present
+func HasLabels(labels map[string]string) bool {
+	for key := range labels {
+		if strings.HasPrefix(key, LabelPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// translate a container's whalewatcher labels into its monitoring config, i.e.
+//
+//	whalewatcher.pattern: "ready to accept connections"
+//	whalewatcher.patterns.0: "started"
+//	whalewatcher.failure_patterns.0: "FATAL"
+//	whalewatcher.max_wait_millis: "30000"
+//	whalewatcher.since: "10m"
+//	whalewatcher.on_timeout: "error"
+//	whalewatcher.mode: "continuous"
+//	whalewatcher.use_healthcheck: "true"
+//	whalewatcher.ready_when: "all"
+//
+// list entries are ordered by their numeric index
+func FromLabels(labels map[string]string) (Container, error) {
+	target := Container{}
+	patterns := map[int]string{}
+	failures := map[int]string{}
+
+	for key, value := range labels {
+		if !strings.HasPrefix(key, LabelPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, LabelPrefix)
+
+		switch {
+		case attr == "pattern":
+			target.Pattern = value
+
+		case attr == "max_wait_millis":
+			millis, err := strconv.Atoi(value)
+			if err != nil {
+				return target, fmt.Errorf("invalid label %s: %q is not an integer", key, value)
+			}
+			target.MaxWaitMillis = millis
+
+		case attr == "since":
+			target.Since = value
+
+		case attr == "on_timeout":
+			target.OnTimeout = value
+
+		case attr == "mode":
+			target.Mode = value
+
+		case attr == "use_healthcheck":
+			use, err := strconv.ParseBool(value)
+			if err != nil {
+				return target, fmt.Errorf("invalid label %s: %q is not a boolean", key, value)
+			}
+			target.UseHealthcheck = &use
+
+		case attr == "ready_when":
+			target.ReadyWhen = value
+
+		case strings.HasPrefix(attr, "patterns."):
+			if err := indexedLabel(patterns, key, strings.TrimPrefix(attr, "patterns."), value); err != nil {
+				return target, err
+			}
+
+		case strings.HasPrefix(attr, "failure_patterns."):
+			if err := indexedLabel(failures, key, strings.TrimPrefix(attr, "failure_patterns."), value); err != nil {
+				return target, err
+			}
+
+		default:
+			return target, fmt.Errorf("unrecognized label %s", key)
+		}
+	}
+
+	target.Patterns = orderedLabels(patterns)
+	target.FailurePatterns = orderedLabels(failures)
+
+	return target, target.Validate()
+}
+
+func indexedLabel(into map[int]string, key, index, value string) error {
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 {
+		return fmt.Errorf("invalid label %s: list index must be a non-negative integer", key)
+	}
+	into[i] = value
+	return nil
+}
+
+func orderedLabels(entries map[int]string) []string {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	indices := make([]int, 0, len(entries))
+	for i := range entries {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+
+	out := make([]string, 0, len(indices))
+	for _, i := range indices {
+		out = append(out, entries[i])
+	}
+	return out
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromLabels(t *testing.T) {
+	labels := map[string]string{
+		"com.docker.compose.service":      "foo",
+		"whalewatcher.pattern":            "ready",
+		"whalewatcher.patterns.10":        "third",
+		"whalewatcher.patterns.0":         "first",
+		"whalewatcher.patterns.2":         "second",
+		"whalewatcher.failure_patterns.0": "FATAL",
+		"whalewatcher.max_wait_millis":    "30000",
+		"whalewatcher.since":              "10m",
+		"whalewatcher.on_timeout":         "error",
+		"whalewatcher.mode":               "continuous",
+		"whalewatcher.use_healthcheck":    "true",
+		"whalewatcher.ready_when":         "any",
+	}
+	require.True(t, HasLabels(labels))
+
+	target, err := FromLabels(labels)
+	require.NoError(t, err)
+	use := true
+	require.Equal(t, Container{
+		Pattern:         "ready",
+		Patterns:        []string{"first", "second", "third"},
+		FailurePatterns: []string{"FATAL"},
+		MaxWaitMillis:   30000,
+		Since:           "10m",
+		OnTimeout:       OnTimeoutError,
+		Mode:            ModeContinuous,
+		UseHealthcheck:  &use,
+		ReadyWhen:       ReadyWhenAny,
+	}, target)
+}
+
+func TestFromLabelsInvalid(t *testing.T) {
+	require.False(t, HasLabels(map[string]string{"com.docker.compose.service": "foo"}))
+
+	for _, labels := range []map[string]string{
+		{"whalewatcher.since": "10m"},
+		{"whalewatcher.pattern": "ready", "whalewatcher.max_wait_millis": "soon"},
+		{"whalewatcher.pattern": "ready", "whalewatcher.patterns.first": "x"},
+		{"whalewatcher.pattern": "ready", "whalewatcher.bogus": "x"},
+		{"whalewatcher.pattern": "(unclosed"},
+		{"whalewatcher.pattern": "ready", "whalewatcher.use_healthcheck": "sure"},
+		{"whalewatcher.pattern": "ready", "whalewatcher.ready_when": "probe"},
+	} {
+		_, err := FromLabels(labels)
+		require.Error(t, err, "%v", labels)
+	}
+}
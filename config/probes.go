@@ -0,0 +1,266 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// policies combining a target's log patterns and probes into its readiness
+const (
+	ReadyWhenLogs  = "logs"
+	ReadyWhenProbe = "probe"
+	ReadyWhenAll   = "all"
+	ReadyWhenAny   = "any"
+)
+
+// defaults for probes that don't set their own timing
+const (
+	DefaultProbeInterval = 2 * time.Second
+	DefaultProbeTimeout  = time.Second
+)
+
+// how often a probe is run, and how long each attempt may take.
+// both accept a time.Duration string
+type ProbeTiming struct {
+	Interval string `yaml:"interval"`
+	Timeout  string `yaml:"timeout"`
+}
+
+// the probe's interval and timeout, with the defaults for those unset
+func (p ProbeTiming) Durations() (interval, timeout time.Duration, err error) {
+	interval, timeout = DefaultProbeInterval, DefaultProbeTimeout
+
+	if len(p.Interval) > 0 {
+		if interval, err = time.ParseDuration(p.Interval); err != nil {
+			return 0, 0, fmt.Errorf("invalid interval %q: %s", p.Interval, err)
+		}
+	}
+	if len(p.Timeout) > 0 {
+		if timeout, err = time.ParseDuration(p.Timeout); err != nil {
+			return 0, 0, fmt.Errorf("invalid timeout %q: %s", p.Timeout, err)
+		}
+	}
+	if interval <= 0 || timeout <= 0 {
+		return 0, 0, fmt.Errorf("interval and timeout must be positive")
+	}
+
+	return interval, timeout, nil
+}
+
+// checks that a TCP connection can be opened to the target, either to a port
+// on the target container's network address or to an explicit host:port
+type TCPProbe struct {
+	Port    int    `yaml:"port"`
+	Address string `yaml:"address"`
+
+	ProbeTiming `yaml:",inline"`
+}
+
+func (p TCPProbe) validate() error {
+	switch {
+	case p.Port == 0 && len(p.Address) == 0:
+		return fmt.Errorf("a port or address is required")
+	case p.Port != 0 && len(p.Address) > 0:
+		return fmt.Errorf("only one of port or address may be set")
+	case p.Port < 0 || p.Port > 65535:
+		return fmt.Errorf("invalid port %d", p.Port)
+	}
+
+	if len(p.Address) > 0 {
+		if _, _, err := net.SplitHostPort(p.Address); err != nil {
+			return fmt.Errorf("invalid address %q: %s", p.Address, err)
+		}
+	}
+
+	_, _, err := p.Durations()
+	return err
+}
+
+// checks the response to an HTTP request made to the target, either to a
+// port and path on the target container's network address or to a full URL
+type HTTPProbe struct {
+	URL  string `yaml:"url"`
+	Port int    `yaml:"port"`
+	Path string `yaml:"path"`
+
+	// optional: the request method (default GET) and headers
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+
+	// optional: the response codes that pass (default any 2xx), and a regex
+	// pattern the response body must match
+	ExpectedStatus []int  `yaml:"expected_status"`
+	BodyPattern    string `yaml:"body_pattern"`
+
+	ProbeTiming `yaml:",inline"`
+}
+
+func (p HTTPProbe) validate() error {
+	switch {
+	case p.Port == 0 && len(p.URL) == 0:
+		return fmt.Errorf("a port or url is required")
+	case p.Port != 0 && len(p.URL) > 0:
+		return fmt.Errorf("only one of port or url may be set")
+	case p.Port < 0 || p.Port > 65535:
+		return fmt.Errorf("invalid port %d", p.Port)
+	case len(p.URL) > 0 && len(p.Path) > 0:
+		return fmt.Errorf("path may only be set with port")
+	case len(p.Path) > 0 && !strings.HasPrefix(p.Path, "/"):
+		return fmt.Errorf("invalid path %q: must begin with /", p.Path)
+	}
+
+	if len(p.URL) > 0 {
+		u, err := url.Parse(p.URL)
+		if err != nil {
+			return fmt.Errorf("invalid url %q: %s", p.URL, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid url %q: expected an http or https url", p.URL)
+		}
+	}
+
+	if _, err := http.NewRequest(p.Method, "http://localhost/", nil); err != nil {
+		return fmt.Errorf("invalid method %q", p.Method)
+	}
+
+	for _, code := range p.ExpectedStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid expected_status %d", code)
+		}
+	}
+
+	if _, err := regexp.Compile(p.BodyPattern); err != nil {
+		return fmt.Errorf("invalid body_pattern %q: %s", p.BodyPattern, err)
+	}
+
+	_, _, err := p.Durations()
+	return err
+}
+
+// runs a command inside the target container, passing if it exits with
+// code 0 and, if output_pattern is set, its output matches it
+type ExecProbe struct {
+	Command       []string `yaml:"command"`
+	OutputPattern string   `yaml:"output_pattern"`
+
+	ProbeTiming `yaml:",inline"`
+}
+
+func (p ExecProbe) validate() error {
+	if len(p.Command) == 0 || len(p.Command[0]) == 0 {
+		return fmt.Errorf("a command is required")
+	}
+
+	if _, err := regexp.Compile(p.OutputPattern); err != nil {
+		return fmt.Errorf("invalid output_pattern %q: %s", p.OutputPattern, err)
+	}
+
+	_, _, err := p.Durations()
+	return err
+}
+
+// checks for a file inside the target container, passing once it exists
+// and, if content_pattern is set, its contents match it
+type FileProbe struct {
+	Path           string `yaml:"path"`
+	ContentPattern string `yaml:"content_pattern"`
+
+	ProbeTiming `yaml:",inline"`
+}
+
+func (p FileProbe) validate() error {
+	if !path.IsAbs(p.Path) {
+		return fmt.Errorf("invalid path %q: must be absolute", p.Path)
+	}
+
+	if _, err := regexp.Compile(p.ContentPattern); err != nil {
+		return fmt.Errorf("invalid content_pattern %q: %s", p.ContentPattern, err)
+	}
+
+	_, _, err := p.Durations()
+	return err
+}
+
+// report whether the target has any probes configured
+func (c Container) HasProbes() bool {
+	return c.TCPProbe != nil || c.HTTPProbe != nil || c.ExecProbe != nil || c.FileProbe != nil || c.UsesHealthcheck()
+}
+
+// report whether the target's readiness considers its container's HEALTHCHECK
+func (c Container) UsesHealthcheck() bool {
+	return c.UseHealthcheck != nil && *c.UseHealthcheck
+}
+
+// report whether the target uses its container's HEALTHCHECK only because of
+// global --use-healthcheck, rather than setting use_healthcheck itself
+func (c Container) HealthcheckDefaulted() bool {
+	return c.UsesHealthcheck() && c.healthcheckDefaulted
+}
+
+// the target's ready_when policy. without one, a target using its container's
+// healthcheck must be healthy, and if it has patterns, have matched one too
+func (c Container) Readiness() string {
+	switch {
+	case len(c.ReadyWhen) > 0:
+		return c.ReadyWhen
+	case !c.UsesHealthcheck():
+		return ReadyWhenLogs
+	case len(c.Pattern) > 0 || len(c.Patterns) > 0:
+		return ReadyWhenAll
+	}
+	return ReadyWhenProbe
+}
+
+// check the target's probes and its ready_when policy
+func (c Container) validateProbes() error {
+	if c.TCPProbe != nil {
+		if err := c.TCPProbe.validate(); err != nil {
+			return fmt.Errorf("invalid tcp_probe: %s", err)
+		}
+	}
+	if c.HTTPProbe != nil {
+		if err := c.HTTPProbe.validate(); err != nil {
+			return fmt.Errorf("invalid http_probe: %s", err)
+		}
+	}
+	if c.ExecProbe != nil {
+		if err := c.ExecProbe.validate(); err != nil {
+			return fmt.Errorf("invalid exec_probe: %s", err)
+		}
+	}
+	if c.FileProbe != nil {
+		if err := c.FileProbe.validate(); err != nil {
+			return fmt.Errorf("invalid file_probe: %s", err)
+		}
+	}
+
+	return c.ValidateReadiness()
+}
+
+// check the target's ready_when policy is recognized, and has the probes it needs
+func (c Container) ValidateReadiness() error {
+	if len(c.ReadyWhen) > 0 && !ValidReadyWhen(c.ReadyWhen) {
+		return fmt.Errorf("invalid ready_when %q: expected one of %s, %s, %s, %s",
+			c.ReadyWhen, ReadyWhenLogs, ReadyWhenProbe, ReadyWhenAll, ReadyWhenAny)
+	}
+	if len(c.ReadyWhen) > 0 && c.ReadyWhen != ReadyWhenLogs && !c.HasProbes() {
+		return fmt.Errorf("ready_when %q requires a probe", c.ReadyWhen)
+	}
+
+	return nil
+}
+
+// report whether policy is a recognized ready_when value
+func ValidReadyWhen(policy string) bool {
+	switch policy {
+	case ReadyWhenLogs, ReadyWhenProbe, ReadyWhenAll, ReadyWhenAny:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigProbes(t *testing.T) {
+	varName := "WHALEWATCHER_CONFIG"
+	yamlBody := `
+containers:
+  demo-redis:
+    pattern: 'Ready to accept connections'
+    ready_when: all
+    tcp_probe:
+      port: 6379
+      interval: 500ms
+  demo-proxy:
+    ready_when: probe
+    tcp_probe:
+      address: 'proxy.internal:8080'
+      timeout: 3s
+  demo-elasticsearch:
+    ready_when: probe
+    http_probe:
+      port: 9200
+      path: /_cluster/health
+      headers:
+        Accept: application/json
+      expected_status: [200]
+      body_pattern: '"status":"(green|yellow)"'
+  demo-postgres:
+    pattern: 'database system is ready'
+    ready_when: all
+    exec_probe:
+      command: [pg_isready, -U, postgres]
+      output_pattern: 'accepting connections'
+      interval: 1s
+  demo-app:
+    ready_when: probe
+    file_probe:
+      path: /tmp/ready
+      content_pattern: 'ok'
+`
+
+	os.Setenv(varName, yamlBody)
+	conf, err := FromVar(varName)
+	require.NoError(t, err)
+	require.NoError(t, conf.Validate())
+
+	redis := conf.Containers["demo-redis"]
+	require.Equal(t, ReadyWhenAll, redis.ReadyWhen)
+	require.Equal(t, 6379, redis.TCPProbe.Port)
+	interval, timeout, err := redis.TCPProbe.Durations()
+	require.NoError(t, err)
+	require.Equal(t, 500*time.Millisecond, interval)
+	require.Equal(t, DefaultProbeTimeout, timeout)
+
+	proxy := conf.Containers["demo-proxy"]
+	require.Empty(t, proxy.Pattern)
+	require.Equal(t, "proxy.internal:8080", proxy.TCPProbe.Address)
+	interval, timeout, err = proxy.TCPProbe.Durations()
+	require.NoError(t, err)
+	require.Equal(t, DefaultProbeInterval, interval)
+	require.Equal(t, 3*time.Second, timeout)
+
+	es := conf.Containers["demo-elasticsearch"]
+	require.Equal(t, 9200, es.HTTPProbe.Port)
+	require.Equal(t, "/_cluster/health", es.HTTPProbe.Path)
+	require.Equal(t, map[string]string{"Accept": "application/json"}, es.HTTPProbe.Headers)
+	require.Equal(t, []int{200}, es.HTTPProbe.ExpectedStatus)
+	require.Equal(t, `"status":"(green|yellow)"`, es.HTTPProbe.BodyPattern)
+
+	pg := conf.Containers["demo-postgres"]
+	require.Equal(t, []string{"pg_isready", "-U", "postgres"}, pg.ExecProbe.Command)
+	require.Equal(t, "accepting connections", pg.ExecProbe.OutputPattern)
+	require.Equal(t, "1s", pg.ExecProbe.Interval)
+
+	app := conf.Containers["demo-app"]
+	require.Equal(t, "/tmp/ready", app.FileProbe.Path)
+	require.Equal(t, "ok", app.FileProbe.ContentPattern)
+}
+
+func TestConfigHealthcheck(t *testing.T) {
+	use, skip := true, false
+	conf := &Config{Containers: map[string]Container{
+		"foo": {Pattern: "ready"},
+		"bar": {Pattern: "ready", UseHealthcheck: &skip},
+		"baz": {UseHealthcheck: &use},
+	}}
+	require.NoError(t, conf.Validate())
+	require.Equal(t, ReadyWhenLogs, conf.Containers["foo"].Readiness())
+	require.Equal(t, ReadyWhenProbe, conf.Containers["baz"].Readiness())
+
+	conf.ApplyDefaults(Defaults{UseHealthcheck: true})
+	require.NoError(t, conf.Validate())
+
+	// the default applies only where the target doesn't opt out, and without a
+	// ready_when a target with patterns needs both a match and a healthy container
+	require.True(t, conf.Containers["foo"].UsesHealthcheck())
+	require.Equal(t, ReadyWhenAll, conf.Containers["foo"].Readiness())
+	require.False(t, conf.Containers["bar"].UsesHealthcheck())
+	require.Equal(t, ReadyWhenLogs, conf.Containers["bar"].Readiness())
+
+	// only a target relying on the default is lenient about a missing HEALTHCHECK
+	require.True(t, conf.Containers["foo"].HealthcheckDefaulted())
+	require.False(t, conf.Containers["bar"].HealthcheckDefaulted())
+	require.False(t, conf.Containers["baz"].HealthcheckDefaulted())
+
+	// a healthcheck can't stand in for patterns the target's ready_when requires
+	require.Error(t, Container{ReadyWhen: ReadyWhenAll, UseHealthcheck: &use}.Validate())
+}
+
+func TestConfigProbesInvalid(t *testing.T) {
+	for _, target := range []Container{
+		{Pattern: "ok", ReadyWhen: "eventually", TCPProbe: &TCPProbe{Port: 80}},
+		{Pattern: "ok", ReadyWhen: ReadyWhenAll},
+		{ReadyWhen: ReadyWhenAny, TCPProbe: &TCPProbe{Port: 80}},
+		{ReadyWhen: ReadyWhenProbe, TCPProbe: &TCPProbe{}},
+		{ReadyWhen: ReadyWhenProbe, TCPProbe: &TCPProbe{Port: 80, Address: "foo:80"}},
+		{ReadyWhen: ReadyWhenProbe, TCPProbe: &TCPProbe{Port: 70000}},
+		{ReadyWhen: ReadyWhenProbe, TCPProbe: &TCPProbe{Address: "no-port"}},
+		{ReadyWhen: ReadyWhenProbe, TCPProbe: &TCPProbe{Port: 80, ProbeTiming: ProbeTiming{Interval: "often"}}},
+		{ReadyWhen: ReadyWhenProbe, TCPProbe: &TCPProbe{Port: 80, ProbeTiming: ProbeTiming{Timeout: "0s"}}},
+		{ReadyWhen: ReadyWhenProbe, HTTPProbe: &HTTPProbe{}},
+		{ReadyWhen: ReadyWhenProbe, HTTPProbe: &HTTPProbe{Port: 80, URL: "http://foo/"}},
+		{ReadyWhen: ReadyWhenProbe, HTTPProbe: &HTTPProbe{URL: "foo:80/health"}},
+		{ReadyWhen: ReadyWhenProbe, HTTPProbe: &HTTPProbe{URL: "http://foo/", Path: "/health"}},
+		{ReadyWhen: ReadyWhenProbe, HTTPProbe: &HTTPProbe{Port: 80, Path: "health"}},
+		{ReadyWhen: ReadyWhenProbe, HTTPProbe: &HTTPProbe{Port: 80, Method: "NOT A METHOD"}},
+		{ReadyWhen: ReadyWhenProbe, HTTPProbe: &HTTPProbe{Port: 80, ExpectedStatus: []int{42}}},
+		{ReadyWhen: ReadyWhenProbe, HTTPProbe: &HTTPProbe{Port: 80, BodyPattern: "(unclosed"}},
+		{ReadyWhen: ReadyWhenProbe, ExecProbe: &ExecProbe{}},
+		{ReadyWhen: ReadyWhenProbe, ExecProbe: &ExecProbe{Command: []string{""}}},
+		{ReadyWhen: ReadyWhenProbe, ExecProbe: &ExecProbe{Command: []string{"true"}, OutputPattern: "(unclosed"}},
+		{ReadyWhen: ReadyWhenProbe, FileProbe: &FileProbe{}},
+		{ReadyWhen: ReadyWhenProbe, FileProbe: &FileProbe{Path: "tmp/ready"}},
+		{ReadyWhen: ReadyWhenProbe, FileProbe: &FileProbe{Path: "/tmp/ready", ContentPattern: "(unclosed"}},
+	} {
+		require.Error(t, target.Validate(), "%+v", target)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// replace whalewatcher's process with the command, so it receives signals
+// and its exit code directly
+func execCommand(path string, args []string) error {
+	return syscall.Exec(path, args, os.Environ())
+}
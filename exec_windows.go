@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "fmt"
+
+// windows can't replace a running process, so there's nothing to hand off to
+func execCommand(path string, args []string) error {
+	return fmt.Errorf("exec is not supported on windows")
+}
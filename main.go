@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -19,37 +21,65 @@ import (
 	docker "github.com/docker/docker/client"
 )
 
+const (
+	// bounds on how long a /wait request is held open
+	defaultWaitTimeout = 60 * time.Second
+	maxWaitTimeout     = 10 * time.Minute
+
+	// interval between comments sent to keep idle /events streams open
+	eventsKeepalive = 15 * time.Second
+)
+
 var (
-	ConfigPath string
-	ConfigVar  string
-	WaitMillis int
-	Port       int
+	ConfigPath     string
+	ConfigVar      string
+	WaitMillis     int
+	OnTimeout      string
+	Port           int
+	Once           bool
+	WatchConfig    time.Duration
+	DiscoverLabels bool
+	ComposeFile    string
+	ComposeProject string
+	DetectProject  bool
+	UseHealthcheck bool
 )
 
 func init() {
 	flag.StringVar(&ConfigPath, "config-path", "/etc/whalewatcher/config.yaml", "path to YAML config file")
 	flag.StringVar(&ConfigVar, "config-var", "", "env var storing the YAML config; overrides config-path if present")
+	flag.StringVar(&ComposeFile, "compose-file", "", "path to a docker-compose file declaring targets in x-whalewatcher service extensions")
+	flag.StringVar(&ComposeProject, "compose-project", "", "compose project of targets selected by service; for --compose-file, defaults to whalewatcher's own project, then the file's name or COMPOSE_PROJECT_NAME")
+	flag.BoolVar(&DetectProject, "detect-project", false, "if --compose-project is unset, use the compose project of whalewatcher's own container; always done with --compose-file")
 	flag.IntVar(&WaitMillis, "wait-millis", 60000, "time to await each container startup; also default time to await ready status")
+	flag.StringVar(&OnTimeout, "on-timeout", config.OnTimeoutReady, "status published when a target's ready wait elapses without a match: ready, error, or timed_out")
+	flag.BoolVar(&UseHealthcheck, "use-healthcheck", false, "treat each target container's HEALTHCHECK status as a probe, unless the target sets use_healthcheck")
 	flag.IntVar(&Port, "port", 4444, "status API will be served on this port")
+	flag.DurationVar(&WatchConfig, "watch-config", 0, "if set, check --config-path and --compose-file for changes at this interval and reload; SIGHUP always reloads")
+	flag.BoolVar(&DiscoverLabels, "discover-labels", true, "monitor containers carrying whalewatcher.* labels in addition to those in the config")
+	flag.BoolVar(&Once, "once", false, "no status API: await all targets ready or any failed, print a summary, and exit with the outcome")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "wait" {
+		os.Exit(runWait(os.Args[2:]))
+	}
+
+	os.Exit(run())
+}
+
+// run the monitor until shutdown, or in --once mode until the targets settle,
+// returning the exit code. deferred cleanup runs before main exits with it
+func run() int {
 	flag.Parse()
 
-	conf, err := populateConfig()
-	if err != nil {
-		panic(err)
+	if !config.ValidOnTimeout(OnTimeout) {
+		panic(fmt.Sprintf("invalid --on-timeout value: %s", OnTimeout))
 	}
 
 	logger := log.New(os.Stdout, "[server] ", log.LstdFlags)
 	publisher := tailer.NewPublisher()
 
-	srv := &http.Server{
-		Addr:     fmt.Sprintf(":%d", Port),
-		Handler:  handler(publisher),
-		ErrorLog: logger,
-	}
-
 	ctx, shutdownTailers := context.WithCancel(context.Background())
 	shutdownComplete := make(chan bool)
 
@@ -59,6 +89,33 @@ func main() {
 	}
 	defer client.Close()
 
+	resolveComposeProject(ctx, client, logger)
+
+	conf, err := loadConfig()
+	if err != nil {
+		panic(err)
+	}
+	for name, target := range conf.Containers {
+		if len(target.Service) > 0 && len(target.Project) > 0 {
+			logger.Printf("INFO target %s selects service %s in compose project %s", name, target.Service, target.Project)
+		} else if len(target.Service) > 0 {
+			logger.Printf("INFO target %s selects service %s in any compose project", name, target.Service)
+		}
+	}
+
+	// a single shared watcher notifies each tailer when its target container starts
+	discovery := tailer.NewDiscovery(client)
+	go discovery.Run(ctx)
+
+	// the manager owns a log monitor for each registered service
+	manager := tailer.NewManager(ctx, client, discovery, publisher, time.Duration(WaitMillis)*time.Millisecond)
+
+	srv := &http.Server{
+		Addr:     fmt.Sprintf(":%d", Port),
+		Handler:  handler(ctx, publisher, manager, logger),
+		ErrorLog: logger,
+	}
+
 	go func() {
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
@@ -66,19 +123,34 @@ func main() {
 
 		logger.Printf("INFO graceful shutdown initiated")
 		shutdownTailers()
+		manager.Shutdown()
 		srv.Shutdown(context.Background())
 		close(shutdownComplete)
 	}()
 
-	// start a log monitor for each registered service we found an ID for
-	awaitStartup := time.Duration(WaitMillis) * time.Millisecond
-	for name, svc := range conf.Containers {
-		svcTailer, err := tailer.New(ctx, client, publisher, name, svc, awaitStartup)
-		if err != nil {
-			panic(err)
-		}
+	if err := manager.Apply(conf); err != nil {
+		panic(err)
+	}
+	if DiscoverLabels {
+		go manager.DiscoverLabeled(config.Defaults{OnTimeout: OnTimeout, Project: ComposeProject, UseHealthcheck: UseHealthcheck})
+	}
+
+	if Once {
+		code := runOnce(ctx, publisher, os.Stdout, time.Duration(WaitMillis)*time.Millisecond)
+		shutdownTailers()
+		manager.Shutdown()
+		return code
+	}
 
-		go svcTailer.Start()
+	// re-read the config on SIGHUP, or when the config file changes if requested
+	reload := make(chan struct{})
+	go watchReloads(ctx, manager, reload, logger)
+	go watchHangups(ctx, reload, logger)
+	if WatchConfig > 0 && len(ConfigVar) == 0 {
+		go watchConfigFile(ctx, ConfigPath, WatchConfig, reload, logger)
+	}
+	if WatchConfig > 0 && len(ComposeFile) > 0 {
+		go watchConfigFile(ctx, ComposeFile, WatchConfig, reload, logger)
 	}
 
 	if err := srv.ListenAndServe(); err != nil {
@@ -87,10 +159,12 @@ func main() {
 
 	<-shutdownComplete
 	logger.Printf("INFO shutdown complete")
+	return 0
 }
 
-// build http.Handler that processes status events
-func handler(pub *tailer.Publisher) http.Handler {
+// build http.Handler that processes status events. long-lived requests
+// are released when ctx is canceled, so they can't stall server shutdown
+func handler(ctx context.Context, pub *tailer.Publisher, manager *tailer.Manager, logger *log.Logger) http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -98,29 +172,333 @@ func handler(pub *tailer.Publisher) http.Handler {
 			return
 		}
 
-		query := r.URL.Query()
-		rawStatuses := query.Get("status")
-		statuses := strings.Split(rawStatuses, ",")
+		statuses, ok := selectTargets(w, r, pub)
+		if !ok {
+			return
+		}
 
 		var out []byte
 		var status int
 
-		if len(rawStatuses) == 0 || (len(statuses) == 1 && statuses[0] == "*") {
+		if len(statuses) == 0 {
 			out, status = pub.GetAll()
 		} else {
 			out, status = pub.GetStatuses(statuses)
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(status)
-		w.Write(out)
+		writeStatus(w, out, status)
+	})
+
+	// long-poll variant of "/": holds the request open until the requested
+	// targets are all ready, any has failed, or the timeout elapses
+	mux.HandleFunc("/wait", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r) {
+			return
+		}
+
+		timeout := defaultWaitTimeout
+		if raw := r.URL.Query().Get("timeout"); len(raw) > 0 {
+			var err error
+			timeout, err = time.ParseDuration(raw)
+			if err != nil || timeout <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, "invalid timeout: expected a positive duration string, i.e. 60s")
+				return
+			}
+			if timeout > maxWaitTimeout {
+				timeout = maxWaitTimeout
+			}
+		}
+
+		targets, ok := selectTargets(w, r, pub)
+		if !ok {
+			return
+		}
+
+		// the wait is also abandoned if the caller hangs up
+		waitCtx, cancel := context.WithTimeout(requestContext(ctx, r), timeout)
+		defer cancel()
+
+		out, status := pub.Wait(waitCtx, targets)
+		writeStatus(w, out, status)
+	})
+
+	// Server-Sent Events stream of status updates, optionally filtered by the
+	// "status" param. clients may resume from the Last-Event-ID they last saw
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r) {
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "streaming not supported")
+			return
+		}
+
+		targets, ok := selectTargets(w, r, pub)
+		if !ok {
+			return
+		}
+		if len(targets) > 0 {
+			if out, status := pub.GetStatuses(targets); status == http.StatusNotFound {
+				writeStatus(w, out, status)
+				return
+			}
+		}
+		wanted := map[string]bool{}
+		for _, name := range targets {
+			wanted[name] = true
+		}
+
+		// without a resume point, stream only updates published from now on
+		last := pub.Sequence()
+		if raw := r.Header.Get("Last-Event-ID"); len(raw) > 0 {
+			id, err := strconv.ParseUint(raw, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, "invalid Last-Event-ID header")
+				return
+			}
+			last = id
+		}
+		last, snapshot := pub.Resume(last)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		// the events the client missed are gone, so send where everything stands instead
+		if snapshot != nil {
+			for name := range snapshot {
+				if len(wanted) > 0 && !wanted[name] {
+					delete(snapshot, name)
+				}
+			}
+			if payload, err := json.Marshal(snapshot); err != nil {
+				logger.Printf("ERROR failed to marshal status snapshot: %s", err)
+			} else {
+				fmt.Fprintf(w, "id: %d\nevent: snapshot\ndata: %s\n\n", last, payload)
+			}
+		}
+		flusher.Flush()
+
+		keepalive := time.NewTicker(eventsKeepalive)
+		defer keepalive.Stop()
+		streamCtx := requestContext(ctx, r)
+
+		for {
+			events, changed := pub.EventsSince(last)
+			for _, evt := range events {
+				last = evt.ID
+				if len(wanted) > 0 && !wanted[evt.Name] {
+					continue
+				}
+
+				payload, err := json.Marshal(evt)
+				if err != nil {
+					logger.Printf("ERROR failed to marshal status event %d: %s", evt.ID, err)
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", evt.ID, payload)
+			}
+			flusher.Flush()
+
+			select {
+			case <-streamCtx.Done():
+				return
+			case <-keepalive.C:
+				io.WriteString(w, ": keepalive\n\n")
+			case <-changed:
+			}
+		}
+	})
+
+	// the dependency graph between targets, with the path currently blocking each
+	mux.HandleFunc("/graph", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r) {
+			return
+		}
+
+		targets, ok := selectTargets(w, r, pub)
+		if !ok {
+			return
+		}
+
+		out, status := pub.GetGraph(targets)
+		writeStatus(w, out, status)
+	})
+
+	// the members of every group, or the status of the targets in one group
+	groups := func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r) {
+			return
+		}
+
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/groups"), "/")
+		if len(name) == 0 {
+			out, status := pub.GetGroups()
+			writeStatus(w, out, status)
+			return
+		}
+
+		members, err := pub.ExpandGroups([]string{name})
+		if err != nil {
+			writeStatus(w, []byte(err.Error()), http.StatusNotFound)
+			return
+		}
+
+		out, status := pub.GetStatuses(members)
+		writeStatus(w, out, status)
+	}
+	mux.HandleFunc("/groups", groups)
+	mux.HandleFunc("/groups/", groups)
+
+	// inventory of the managed targets, and whether their tailers are still running
+	mux.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r) {
+			return
+		}
+
+		out, err := json.Marshal(manager.Targets())
+		if err != nil {
+			logger.Printf("ERROR failed to marshal target inventory: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "failed to serialize target inventory")
+			return
+		}
+
+		writeStatus(w, out, http.StatusOK)
 	})
 
 	return mux
 }
 
-// hydrate the YAML configuration from a file or env var
+// a context canceled when either the request or the server (via ctx) is done
+func requestContext(ctx context.Context, r *http.Request) context.Context {
+	reqCtx, cancel := context.WithCancel(r.Context())
+	go func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+		case <-reqCtx.Done():
+		}
+	}()
+
+	return reqCtx
+}
+
+// the targets selected by the "status" and "group" query params; empty means
+// all targets. responds with a 404 if any requested group isn't defined
+func selectTargets(w http.ResponseWriter, r *http.Request, pub *tailer.Publisher) ([]string, bool) {
+	statuses := requestedTargets(r)
+
+	rawGroups := r.URL.Query().Get("group")
+	if len(rawGroups) == 0 {
+		return statuses, true
+	}
+
+	members, err := pub.ExpandGroups(strings.Split(rawGroups, ","))
+	if err != nil {
+		writeStatus(w, []byte(err.Error()), http.StatusNotFound)
+		return nil, false
+	}
+
+	seen := map[string]bool{}
+	targets := []string{}
+	for _, name := range append(statuses, members...) {
+		if !seen[name] {
+			seen[name] = true
+			targets = append(targets, name)
+		}
+	}
+
+	return targets, true
+}
+
+// the targets selected by the "status" query param; empty means all targets
+func requestedTargets(r *http.Request) []string {
+	rawStatuses := r.URL.Query().Get("status")
+	statuses := strings.Split(rawStatuses, ",")
+
+	if len(rawStatuses) == 0 || (len(statuses) == 1 && statuses[0] == "*") {
+		return nil
+	}
+
+	return statuses
+}
+
+func writeStatus(w http.ResponseWriter, out []byte, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// scope targets selected by compose service to whalewatcher's own project, if
+// not set with --compose-project. compose file targets default to it too, as the
+// directory holding a file mounted into whalewatcher's container names no project
+func resolveComposeProject(ctx context.Context, client docker.APIClient, logger *log.Logger) {
+	if len(ComposeProject) > 0 {
+		logger.Printf("INFO matching compose services in project %s", ComposeProject)
+		return
+	}
+	if !DetectProject && len(ComposeFile) == 0 {
+		return
+	}
+
+	project, err := tailer.DetectComposeProject(ctx, client)
+	if err != nil {
+		logger.Printf("WARN unable to detect compose project, matching services in any project unless the compose file names one: %s", err)
+		return
+	}
+
+	logger.Printf("INFO detected compose project %s", project)
+	ComposeProject = project
+}
+
+// hydrate, fill in global defaults for, and validate the YAML configuration
+func loadConfig() (*config.Config, error) {
+	conf, err := populateConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conf.ApplyDefaults(config.Defaults{OnTimeout: OnTimeout, Project: ComposeProject, UseHealthcheck: UseHealthcheck})
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+// hydrate the YAML configuration from a file or env var, merged over
+// any targets declared in the compose file
 func populateConfig() (*config.Config, error) {
+	if len(ComposeFile) == 0 {
+		return populateStaticConfig()
+	}
+
+	conf, err := config.FromCompose(ComposeFile, ComposeProject)
+	if err != nil {
+		return nil, err
+	}
+
+	// alongside a compose file, the config file is optional
+	if _, err := os.Stat(ConfigPath); len(ConfigVar) > 0 || err == nil {
+		static, err := populateStaticConfig()
+		if err != nil {
+			return nil, err
+		}
+		conf.Merge(static)
+	}
+
+	return conf, nil
+}
+
+// hydrate the YAML configuration from a file or env var
+func populateStaticConfig() (*config.Config, error) {
 	if len(ConfigVar) > 0 {
 		return config.FromVar(ConfigVar)
 	}
@@ -129,6 +507,11 @@ func populateConfig() (*config.Config, error) {
 		return config.FromFile(ConfigPath)
 	}
 
+	// all targets may be discovered from container labels instead
+	if DiscoverLabels {
+		return &config.Config{Containers: map[string]config.Container{}}, nil
+	}
+
 	return nil, fmt.Errorf("failed to locate YAML config at path %q or in env var %q", ConfigPath, ConfigVar)
 }
 
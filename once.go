@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/elireisman/whalewatcher/tailer"
+	"github.com/elireisman/whalewatcher/waiter"
+)
+
+// in --once mode, block until every target is ready or any has failed, then
+// print a summary table and report the outcome as the process exit code.
+// targets may all be discovered from labels, so until one is registered the
+// wait is pending rather than trivially ready; if none is within startup, fail
+func runOnce(ctx context.Context, pub *tailer.Publisher, out io.Writer, startup time.Duration) int {
+	if !awaitTargets(ctx, pub, startup) {
+		if ctx.Err() != nil {
+			return waiter.ExitInterrupted
+		}
+		fmt.Fprintf(out, "no targets registered within %s\n", startup)
+		return waiter.ExitNotFound
+	}
+
+	_, status := pub.Wait(ctx, nil)
+	interrupted := ctx.Err() != nil
+
+	printSummary(out, pub.Snapshot())
+
+	switch {
+	case interrupted:
+		return waiter.ExitInterrupted
+	case status == http.StatusOK:
+		return waiter.ExitReady
+	case status == http.StatusServiceUnavailable:
+		return waiter.ExitFailed
+	case status == http.StatusGatewayTimeout:
+		return waiter.ExitTimeout
+	}
+
+	return waiter.ExitError
+}
+
+// block until at least one target is registered, reporting false if ctx is
+// done or the timeout elapses first
+func awaitTargets(ctx context.Context, pub *tailer.Publisher, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		// grab the channel before reading status so no update can slip between them
+		changed := pub.Changed()
+		if len(pub.Snapshot()) > 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline.C:
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// render one row per target: name, phase, readiness and any error detail
+func printSummary(out io.Writer, statuses map[string]tailer.Status) {
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TARGET\tPHASE\tREADY\tDETAIL")
+
+	for _, name := range names {
+		status := statuses[name]
+		detail := status.Error
+		if status.Ready && status.TimedOut {
+			detail = "ready inferred from timeout"
+		}
+		if len(status.Replicas) > 0 && len(detail) == 0 {
+			ready := 0
+			for _, replica := range status.Replicas {
+				if replica.Ready {
+					ready++
+				}
+			}
+			detail = fmt.Sprintf("%d of %d replicas ready", ready, len(status.Replicas))
+		}
+		fmt.Fprintf(table, "%s\t%s\t%t\t%s\n", name, status.Phase, status.Ready, detail)
+	}
+
+	table.Flush()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/elireisman/whalewatcher/tailer"
+	"github.com/elireisman/whalewatcher/waiter"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunOnceExitCodes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses map[string]tailer.Status
+		timeout  time.Duration
+		expected int
+	}{
+		{
+			name: "ready",
+			statuses: map[string]tailer.Status{
+				"foo": {Ready: true, Phase: tailer.PhaseReady},
+				"bar": {Ready: true, Phase: tailer.PhaseReady},
+			},
+			expected: waiter.ExitReady,
+		},
+		{
+			name: "failed",
+			statuses: map[string]tailer.Status{
+				"foo": {Ready: true, Phase: tailer.PhaseReady},
+				"bar": {Phase: tailer.PhaseFailed, Error: "boom"},
+			},
+			expected: waiter.ExitFailed,
+		},
+		{
+			name: "timed out",
+			statuses: map[string]tailer.Status{
+				"foo": {Ready: true, Phase: tailer.PhaseReady},
+				"bar": {TimedOut: true, Phase: tailer.PhaseTimedOut},
+			},
+			expected: waiter.ExitTimeout,
+		},
+		{
+			name: "interrupted",
+			statuses: map[string]tailer.Status{
+				"foo": {Phase: tailer.PhaseStreaming},
+			},
+			timeout:  50 * time.Millisecond,
+			expected: waiter.ExitInterrupted,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pub := tailer.NewPublisher()
+			for name, status := range tc.statuses {
+				pub.Add(name, status)
+			}
+
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+
+			out := &bytes.Buffer{}
+			require.Equal(t, tc.expected, runOnce(ctx, pub, out, time.Minute))
+			for name := range tc.statuses {
+				require.Contains(t, out.String(), name)
+			}
+		})
+	}
+}
+
+func TestRunOnceAwaitsDiscoveredTargets(t *testing.T) {
+	// with every target discovered from labels, nothing is registered at first
+	pub := tailer.NewPublisher()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pub.Add("foo", tailer.Status{Phase: tailer.PhaseStreaming})
+		time.Sleep(50 * time.Millisecond)
+		pub.Add("foo", tailer.Status{Ready: true, Phase: tailer.PhaseReady})
+	}()
+
+	out := &bytes.Buffer{}
+	require.Equal(t, waiter.ExitReady, runOnce(context.Background(), pub, out, time.Minute))
+	require.Contains(t, out.String(), "foo")
+
+	// if none turns up in time, the run fails rather than passing vacuously
+	out.Reset()
+	require.Equal(t, waiter.ExitNotFound, runOnce(context.Background(), tailer.NewPublisher(), out, 50*time.Millisecond))
+	require.Equal(t, "no targets registered within 50ms\n", out.String())
+}
+
+func TestPrintSummary(t *testing.T) {
+	out := &bytes.Buffer{}
+	printSummary(out, map[string]tailer.Status{
+		"demo-zookeeper": {Ready: true, Phase: tailer.PhaseReady},
+		"demo-kafka":     {Phase: tailer.PhaseFailed, Error: "matched failure pattern"},
+		"demo-redis":     {Ready: true, TimedOut: true, Phase: tailer.PhaseReady},
+		"demo-worker": {Phase: tailer.PhaseStreaming, Replicas: map[string]tailer.Status{
+			"demo-worker-1": {Ready: true, Phase: tailer.PhaseReady},
+			"demo-worker-2": {Phase: tailer.PhaseStreaming},
+		}},
+	})
+
+	expected := "TARGET          PHASE      READY  DETAIL\n" +
+		"demo-kafka      failed     false  matched failure pattern\n" +
+		"demo-redis      ready      true   ready inferred from timeout\n" +
+		"demo-worker     streaming  false  1 of 2 replicas ready\n" +
+		"demo-zookeeper  ready      true   \n"
+	require.Equal(t, expected, out.String())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/elireisman/whalewatcher/tailer"
+)
+
+// re-read the config, applying it if valid. a bad config is logged and
+// ignored, leaving the current targets running
+func reloadConfig(manager *tailer.Manager, logger *log.Logger) {
+	conf, err := loadConfig()
+	if err != nil {
+		logger.Printf("ERROR config reload failed, keeping current config: %s", err)
+		return
+	}
+
+	if err := manager.Apply(conf); err != nil {
+		logger.Printf("ERROR config reload partially applied: %s", err)
+		return
+	}
+	logger.Printf("INFO config reloaded, monitoring %d targets", len(manager.Targets()))
+}
+
+// reload the config whenever reload fires, until ctx is canceled
+func watchReloads(ctx context.Context, manager *tailer.Manager, reload <-chan struct{}, logger *log.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			reloadConfig(manager, logger)
+		}
+	}
+}
+
+// signal a reload on each SIGHUP, until ctx is canceled
+func watchHangups(ctx context.Context, reload chan<- struct{}, logger *log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hup:
+			logger.Println("INFO SIGHUP received, reloading config")
+			select {
+			case reload <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// signal a reload when the file at path is modified, checking every interval
+func watchConfigFile(ctx context.Context, path string, interval time.Duration, reload chan<- struct{}, logger *log.Logger) {
+	last, err := os.Stat(path)
+	if err != nil {
+		logger.Printf("WARN unable to watch config file %s: %s", path, err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+
+			logger.Printf("INFO config file %s changed", path)
+			select {
+			case reload <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
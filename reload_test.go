@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/elireisman/whalewatcher/config"
+	"github.com/elireisman/whalewatcher/tailer"
+
+	"github.com/stretchr/testify/require"
+)
+
+// point the config flags at a file in a temp dir. the returned func restores them
+func useConfigFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "wwreload")
+	require.NoError(t, err)
+
+	path, configVar, composeFile, onTimeout := ConfigPath, ConfigVar, ComposeFile, OnTimeout
+	restore := func() {
+		ConfigPath, ConfigVar, ComposeFile, OnTimeout = path, configVar, composeFile, onTimeout
+		os.RemoveAll(dir)
+	}
+
+	ConfigPath = filepath.Join(dir, "config.yaml")
+	ConfigVar, ComposeFile, OnTimeout = "", "", config.OnTimeoutReady
+	return ConfigPath, restore
+}
+
+func writeConfig(t *testing.T, path, body string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(body), 0644))
+}
+
+func targetsByName(manager *tailer.Manager) map[string]tailer.TargetInfo {
+	out := map[string]tailer.TargetInfo{}
+	for _, info := range manager.Targets() {
+		out[info.Name] = info
+	}
+	return out
+}
+
+func targetNames(manager *tailer.Manager) []string {
+	names := []string{}
+	for name := range targetsByName(manager) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestReloadConfig(t *testing.T) {
+	path, restore := useConfigFile(t)
+	defer restore()
+	logger := log.New(ioutil.Discard, "", 0)
+
+	// no container ever starts, so the tailers never touch the docker client
+	manager := tailer.NewManager(context.Background(), nil, tailer.NewDiscovery(nil), tailer.NewPublisher(), time.Minute)
+	defer manager.Shutdown()
+
+	writeConfig(t, path, `
+containers:
+  foo:
+    pattern: foo
+  bar:
+    pattern: bar
+  baz:
+    pattern: baz
+`)
+	reloadConfig(manager, logger)
+	require.Equal(t, []string{"bar", "baz", "foo"}, targetNames(manager))
+	before := targetsByName(manager)
+
+	// foo is unchanged, bar is changed, baz is removed, and qux is added
+	writeConfig(t, path, `
+containers:
+  foo:
+    pattern: foo
+  bar:
+    pattern: bar2
+  qux:
+    pattern: qux
+`)
+	reloadConfig(manager, logger)
+	require.Equal(t, []string{"bar", "foo", "qux"}, targetNames(manager))
+
+	after := targetsByName(manager)
+	require.Equal(t, before["foo"].StartedAt, after["foo"].StartedAt)
+	require.Equal(t, "bar2", after["bar"].Config.Pattern)
+	require.True(t, after["bar"].StartedAt.After(before["bar"].StartedAt))
+
+	// an invalid config is ignored, leaving the current targets running
+	writeConfig(t, path, `
+containers:
+  foo:
+    pattern: '(unclosed'
+`)
+	reloadConfig(manager, logger)
+	require.Equal(t, []string{"bar", "foo", "qux"}, targetNames(manager))
+	require.Equal(t, after["foo"].StartedAt, targetsByName(manager)["foo"].StartedAt)
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	path, restore := useConfigFile(t)
+	defer restore()
+	writeConfig(t, path, "containers: {}\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchConfigFile(ctx, path, 10*time.Millisecond, reload, log.New(ioutil.Discard, "", 0))
+	}()
+
+	// an untouched file never signals a reload
+	select {
+	case <-reload:
+		t.Fatal("reload signaled for an unchanged config file")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	writeConfig(t, path, "containers:\n  foo:\n    pattern: foo\n")
+	select {
+	case <-reload:
+	case <-time.After(time.Second):
+		t.Fatal("reload never signaled for a changed config file")
+	}
+
+	// the watcher returns on cancellation even with a reload pending delivery
+	writeConfig(t, path, "containers:\n  bar:\n    pattern: bar\n")
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watcher didn't return after its context was canceled")
+	}
+}
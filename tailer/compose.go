@@ -0,0 +1,35 @@
+package tailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/elireisman/whalewatcher/config"
+
+	docker "github.com/docker/docker/client"
+)
+
+// obtain the compose project whalewatcher itself was started in, from the
+// labels on its own container. within a container, the hostname is its ID
+func DetectComposeProject(ctx context.Context, client docker.APIClient) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain hostname: %s", err)
+	}
+
+	info, err := client.ContainerInspect(ctx, hostname)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect own container %s: %s", hostname, err)
+	}
+
+	var project string
+	if info.Config != nil {
+		project = info.Config.Labels[config.ComposeProjectLabel]
+	}
+	if len(project) == 0 {
+		return "", fmt.Errorf("own container %s has no %s label", hostname, config.ComposeProjectLabel)
+	}
+
+	return project, nil
+}
@@ -0,0 +1,55 @@
+package tailer
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/elireisman/whalewatcher/config"
+
+	docker_types "github.com/docker/docker/api/types"
+	docker_container "github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchByComposeService(t *testing.T) {
+	targetConf := config.Container{Pattern: "ready", Service: "redis", Project: "demo"}
+	tailer, err := New(context.TODO(), nil, nil, NewPublisher(), "redis", targetConf, time.Second)
+	require.NoError(t, err)
+
+	labels := func(project, service string) map[string]string {
+		return map[string]string{config.ComposeProjectLabel: project, config.ComposeServiceLabel: service}
+	}
+
+	// the generated container name doesn't matter, whichever compose version made it
+	require.True(t, tailer.matches(ContainerInfo{Name: "demo-redis-1", Labels: labels("demo", "redis")}))
+	require.True(t, tailer.matches(ContainerInfo{Name: "demo_redis_1", Labels: labels("demo", "redis")}))
+	require.False(t, tailer.matches(ContainerInfo{Name: "demo-redis-1"}))
+	require.True(t, tailer.matches(ContainerInfo{Name: "anything", Labels: labels("demo", "redis")}))
+	require.False(t, tailer.matches(ContainerInfo{Name: "redis", Labels: labels("other", "redis")}))
+	require.False(t, tailer.matches(ContainerInfo{Name: "redis"}))
+
+	// without a project, the service is matched in any project
+	tailer.Project = ""
+	require.True(t, tailer.matches(ContainerInfo{Name: "redis", Labels: labels("other", "redis")}))
+}
+
+func TestDetectComposeProject(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	client := &fakeDocker{containers: map[string]docker_types.ContainerJSON{}}
+	_, err = DetectComposeProject(context.TODO(), client)
+	require.Error(t, err)
+
+	client.containers[hostname] = docker_types.ContainerJSON{
+		ContainerJSONBase: &docker_types.ContainerJSONBase{ID: hostname},
+		Config: &docker_container.Config{Labels: map[string]string{
+			config.ComposeProjectLabel: "demo",
+		}},
+	}
+	project, err := DetectComposeProject(context.TODO(), client)
+	require.NoError(t, err)
+	require.Equal(t, "demo", project)
+}
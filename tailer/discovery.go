@@ -0,0 +1,357 @@
+package tailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	docker_types "github.com/docker/docker/api/types"
+	docker_events "github.com/docker/docker/api/types/events"
+	docker_filters "github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+)
+
+// container lifecycle events Discovery tracks and relays to subscribers
+const (
+	ActionStart   = "start"
+	ActionDie     = "die"
+	ActionDestroy = "destroy"
+	ActionRename  = "rename"
+
+	// a container's healthcheck status changed; docker reports the new
+	// status after the action, i.e. "health_status: healthy"
+	ActionHealthStatus = "health_status"
+)
+
+// time to wait before resubscribing when the Docker event stream is interrupted
+const discoveryRetryInterval = 3 * time.Second
+
+// what Discovery knows about a container on the host
+type ContainerInfo struct {
+	ID      string
+	Name    string
+	Labels  map[string]string
+	Running bool
+}
+
+// a lifecycle change for a container matched by a subscription
+type ContainerEvent struct {
+	Action    string
+	Container ContainerInfo
+}
+
+// Discovery is shared by all tailers: it lists the host's containers once,
+// then follows the Docker events stream, notifying each subscriber as soon
+// as a container matching its selector starts, stops, or is renamed.
+type Discovery struct {
+	client docker.APIClient
+	logger *log.Logger
+
+	lock       *sync.Mutex
+	containers map[string]ContainerInfo
+	subs       map[*Subscription]bool
+}
+
+// obtain a Discovery; call Run to begin tracking containers
+func NewDiscovery(client docker.APIClient) *Discovery {
+	return &Discovery{
+		client:     client,
+		logger:     log.New(os.Stdout, "[discovery] ", log.LstdFlags),
+		lock:       &sync.Mutex{},
+		containers: map[string]ContainerInfo{},
+		subs:       map[*Subscription]bool{},
+	}
+}
+
+// caller should execute this in a goroutine; returns when ctx is canceled
+func (d *Discovery) Run(ctx context.Context) {
+	for {
+		err := d.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		d.logger.Printf("WARN docker event stream interrupted, resubscribing in %s: %s", discoveryRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(discoveryRetryInterval):
+		}
+	}
+}
+
+// register interest in containers selected by match. any matching containers
+// already running are delivered as start events immediately. the caller must
+// Close the subscription when finished with it
+func (d *Discovery) Subscribe(match func(ContainerInfo) bool) *Subscription {
+	events := make(chan ContainerEvent)
+	sub := &Subscription{
+		Events: events,
+		disco:  d,
+		match:  match,
+		in:     make(chan ContainerEvent),
+		done:   make(chan struct{}),
+	}
+	go sub.pump(events)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.subs[sub] = true
+	for _, info := range d.containers {
+		if info.Running && match(info) {
+			sub.deliver(ContainerEvent{Action: ActionStart, Container: info})
+		}
+	}
+
+	return sub
+}
+
+// subscribe to container events, then reconcile against a fresh listing so
+// nothing starting in between the two calls can be missed
+func (d *Discovery) watch(ctx context.Context) error {
+	opts := docker_types.EventsOptions{Filters: docker_filters.NewArgs()}
+	opts.Filters.Add("type", docker_events.ContainerEventType)
+	for _, action := range []string{ActionStart, ActionDie, ActionDestroy, ActionRename, ActionHealthStatus} {
+		opts.Filters.Add("event", action)
+	}
+	messages, errs := d.client.Events(ctx, opts)
+
+	if err := d.sync(ctx); err != nil {
+		return err
+	}
+	d.logger.Println("INFO watching docker events for container lifecycle changes")
+
+	for {
+		select {
+		case msg := <-messages:
+			d.handleEvent(ctx, msg)
+
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+// list running containers, emitting start and die events for any
+// containers whose state changed since the last time we looked
+func (d *Discovery) sync(ctx context.Context) error {
+	opts := docker_types.ContainerListOptions{Filters: docker_filters.NewArgs()}
+	opts.Filters.Add("status", "running")
+
+	containers, err := d.client.ContainerList(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to obtain container listing: %s", err)
+	}
+
+	listed := map[string]bool{}
+	for _, container := range containers {
+		listed[container.ID] = true
+		d.started(ContainerInfo{
+			ID:      container.ID,
+			Name:    containerName(container.Names),
+			Labels:  container.Labels,
+			Running: true,
+		})
+	}
+
+	for _, info := range d.snapshot() {
+		if info.Running && !listed[info.ID] {
+			d.stopped(info.ID, ActionDie)
+		}
+	}
+
+	return nil
+}
+
+func (d *Discovery) handleEvent(ctx context.Context, msg docker_events.Message) {
+	switch msg.Action {
+	case ActionStart:
+		info, err := d.client.ContainerInspect(ctx, msg.Actor.ID)
+		if err != nil {
+			d.logger.Printf("WARN failed to inspect started container %s: %s", msg.Actor.ID, err)
+			return
+		}
+		var labels map[string]string
+		if info.Config != nil {
+			labels = info.Config.Labels
+		}
+		d.started(ContainerInfo{
+			ID:      info.ID,
+			Name:    strings.TrimPrefix(info.Name, "/"),
+			Labels:  labels,
+			Running: info.State != nil && info.State.Running,
+		})
+
+	case ActionDie, ActionDestroy:
+		d.stopped(msg.Actor.ID, msg.Action)
+
+	case ActionRename:
+		d.renamed(msg.Actor.ID, msg.Actor.Attributes["name"])
+
+	default:
+		if strings.HasPrefix(msg.Action, ActionHealthStatus+":") {
+			d.healthChanged(msg.Actor.ID)
+		}
+	}
+}
+
+// record a running container, notifying subscribers if it wasn't already known to be up
+func (d *Discovery) started(info ContainerInfo) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if known, ok := d.containers[info.ID]; ok && known.Running {
+		return
+	}
+	d.containers[info.ID] = info
+
+	if info.Running {
+		d.notify(ContainerEvent{Action: ActionStart, Container: info}, info)
+	}
+}
+
+// record a container exit (die) or removal (destroy), notifying subscribers
+func (d *Discovery) stopped(id, action string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	info, ok := d.containers[id]
+	if !ok {
+		return
+	}
+
+	wasRunning := info.Running
+	info.Running = false
+	if action == ActionDestroy {
+		delete(d.containers, id)
+	} else {
+		d.containers[id] = info
+	}
+
+	if wasRunning || action == ActionDestroy {
+		d.notify(ContainerEvent{Action: action, Container: info}, info)
+	}
+}
+
+// record a container's new name; subscribers matching either name are notified
+func (d *Discovery) renamed(id, name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	previous, ok := d.containers[id]
+	if !ok || len(name) == 0 {
+		return
+	}
+
+	info := previous
+	info.Name = strings.TrimPrefix(name, "/")
+	d.containers[id] = info
+
+	d.notify(ContainerEvent{Action: ActionRename, Container: info}, previous)
+}
+
+// relay a running container's healthcheck status change to its subscribers
+func (d *Discovery) healthChanged(id string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	info, ok := d.containers[id]
+	if !ok || !info.Running {
+		return
+	}
+
+	d.notify(ContainerEvent{Action: ActionHealthStatus, Container: info}, info)
+}
+
+// caller must hold the lock
+func (d *Discovery) notify(evt ContainerEvent, previous ContainerInfo) {
+	for sub := range d.subs {
+		if sub.match(evt.Container) || sub.match(previous) {
+			sub.deliver(evt)
+		}
+	}
+}
+
+func (d *Discovery) unsubscribe(sub *Subscription) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.subs, sub)
+}
+
+func (d *Discovery) snapshot() []ContainerInfo {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	out := make([]ContainerInfo, 0, len(d.containers))
+	for _, info := range d.containers {
+		out = append(out, info)
+	}
+
+	return out
+}
+
+// a stream of events for the containers selected by one subscriber.
+// delivery is buffered without bound so a slow subscriber never
+// stalls Discovery or the other subscribers
+type Subscription struct {
+	Events <-chan ContainerEvent
+
+	disco *Discovery
+	match func(ContainerInfo) bool
+	in    chan ContainerEvent
+	done  chan struct{}
+	once  sync.Once
+}
+
+// stop receiving events; Events is closed once the subscription is torn down
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		if s.disco != nil {
+			s.disco.unsubscribe(s)
+		}
+		close(s.done)
+	})
+}
+
+func (s *Subscription) deliver(evt ContainerEvent) {
+	select {
+	case s.in <- evt:
+	case <-s.done:
+	}
+}
+
+func (s *Subscription) pump(out chan<- ContainerEvent) {
+	defer close(out)
+
+	queue := []ContainerEvent{}
+	for {
+		var send chan<- ContainerEvent
+		var next ContainerEvent
+		if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+
+		select {
+		case evt := <-s.in:
+			queue = append(queue, evt)
+		case send <- next:
+			queue = queue[1:]
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func containerName(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(names[0], "/")
+}
@@ -0,0 +1,118 @@
+package tailer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	docker_events "github.com/docker/docker/api/types/events"
+	"github.com/stretchr/testify/require"
+)
+
+func byName(name string) func(ContainerInfo) bool {
+	return func(info ContainerInfo) bool { return info.Name == name }
+}
+
+func nextEvent(t *testing.T, sub *Subscription) ContainerEvent {
+	select {
+	case evt := <-sub.Events:
+		return evt
+	case <-time.After(time.Second):
+		require.FailNow(t, "timed out awaiting container event")
+	}
+	return ContainerEvent{}
+}
+
+func requireNoEvent(t *testing.T, sub *Subscription) {
+	select {
+	case evt := <-sub.Events:
+		require.FailNow(t, "unexpected container event", "%+v", evt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDiscoveryDeliversRunningContainersOnSubscribe(t *testing.T) {
+	disco := NewDiscovery(nil)
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true})
+	disco.started(ContainerInfo{ID: "def", Name: "bar", Running: true})
+
+	sub := disco.Subscribe(byName("foo"))
+	defer sub.Close()
+
+	evt := nextEvent(t, sub)
+	require.Equal(t, ActionStart, evt.Action)
+	require.Equal(t, "abc", evt.Container.ID)
+	requireNoEvent(t, sub)
+}
+
+func TestDiscoveryNotifiesOnStartAndDie(t *testing.T) {
+	disco := NewDiscovery(nil)
+	sub := disco.Subscribe(byName("foo"))
+	defer sub.Close()
+
+	disco.started(ContainerInfo{ID: "def", Name: "bar", Running: true})
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true})
+	// duplicate start (i.e. from a resync listing) is not redelivered
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true})
+	disco.stopped("abc", ActionDie)
+
+	evt := nextEvent(t, sub)
+	require.Equal(t, ActionStart, evt.Action)
+	require.Equal(t, "abc", evt.Container.ID)
+
+	evt = nextEvent(t, sub)
+	require.Equal(t, ActionDie, evt.Action)
+	require.False(t, evt.Container.Running)
+	requireNoEvent(t, sub)
+}
+
+func TestDiscoveryRenameMatchesNewName(t *testing.T) {
+	disco := NewDiscovery(nil)
+	disco.started(ContainerInfo{ID: "abc", Name: "old", Running: true})
+
+	sub := disco.Subscribe(byName("foo"))
+	defer sub.Close()
+	requireNoEvent(t, sub)
+
+	disco.renamed("abc", "/foo")
+
+	evt := nextEvent(t, sub)
+	require.Equal(t, ActionRename, evt.Action)
+	require.Equal(t, "foo", evt.Container.Name)
+	require.True(t, evt.Container.Running)
+}
+
+func TestDiscoveryRelaysHealthStatus(t *testing.T) {
+	disco := NewDiscovery(nil)
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true})
+
+	sub := disco.Subscribe(byName("foo"))
+	defer sub.Close()
+	nextEvent(t, sub)
+
+	disco.handleEvent(context.TODO(), docker_events.Message{
+		Action: "health_status: healthy",
+		Actor:  docker_events.Actor{ID: "abc"},
+	})
+	evt := nextEvent(t, sub)
+	require.Equal(t, ActionHealthStatus, evt.Action)
+	require.Equal(t, "abc", evt.Container.ID)
+
+	// an exited container's late health report is dropped
+	disco.stopped("abc", ActionDie)
+	nextEvent(t, sub)
+	disco.healthChanged("abc")
+	requireNoEvent(t, sub)
+}
+
+func TestDiscoveryClosedSubscriptionStopsDelivery(t *testing.T) {
+	disco := NewDiscovery(nil)
+	sub := disco.Subscribe(byName("foo"))
+	sub.Close()
+
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true})
+
+	_, open := <-sub.Events
+	require.False(t, open)
+	require.Empty(t, disco.subs)
+}
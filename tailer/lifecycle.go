@@ -0,0 +1,83 @@
+package tailer
+
+import (
+	"fmt"
+	"time"
+)
+
+// the lifecycle phase of a monitored target, published in its Status
+type Phase string
+
+const (
+	PhaseRegistered        Phase = "registered"
+	PhaseAwaitingContainer Phase = "awaiting_container"
+	PhaseStreaming         Phase = "streaming"
+	PhaseReady             Phase = "ready"
+	PhaseTimedOut          Phase = "timed_out"
+	PhaseFailed            Phase = "failed"
+	PhaseContainerExited   Phase = "container_exited"
+	PhaseShuttingDown      Phase = "shutting_down"
+
+	// published in place of ready while a target's dependencies aren't all
+	// ready yet. a tailer never enters this phase itself
+	PhaseBlocked Phase = "blocked"
+)
+
+// the phases reachable from each phase; anything else is a bug in the tailer
+var transitions = map[Phase][]Phase{
+	"":                     {PhaseRegistered},
+	PhaseRegistered:        {PhaseAwaitingContainer, PhaseFailed, PhaseShuttingDown},
+	PhaseAwaitingContainer: {PhaseStreaming, PhaseFailed, PhaseShuttingDown},
+	PhaseStreaming:         {PhaseReady, PhaseTimedOut, PhaseFailed, PhaseContainerExited, PhaseShuttingDown},
+	PhaseReady:             {PhaseContainerExited, PhaseShuttingDown},
+	PhaseTimedOut:          {PhaseContainerExited, PhaseShuttingDown},
+	PhaseFailed:            {PhaseContainerExited, PhaseShuttingDown},
+	PhaseContainerExited:   {PhaseAwaitingContainer, PhaseFailed, PhaseShuttingDown},
+	PhaseShuttingDown:      {},
+}
+
+// tracks a tailer's current phase and when each phase was (last) entered
+type lifecycle struct {
+	phase   Phase
+	entered map[Phase]time.Time
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{entered: map[Phase]time.Time{}}
+}
+
+// move to the next phase, if the transition is a valid one
+func (l *lifecycle) enter(next Phase, at time.Time) error {
+	if !canTransition(l.phase, next) {
+		return fmt.Errorf("invalid phase transition: %q -> %q", l.phase, next)
+	}
+
+	l.phase = next
+	l.entered[next] = at
+	return nil
+}
+
+// move to failed from whatever the current phase is. only for a crashed
+// tailer, whose last published phase can't be trusted to still hold
+func (l *lifecycle) crash(at time.Time) {
+	l.phase = PhaseFailed
+	l.entered[PhaseFailed] = at
+}
+
+// copy of the phase entry times, safe to hand off to the Publisher
+func (l *lifecycle) history() map[Phase]time.Time {
+	out := make(map[Phase]time.Time, len(l.entered))
+	for phase, at := range l.entered {
+		out[phase] = at
+	}
+	return out
+}
+
+func canTransition(from, to Phase) bool {
+	for _, candidate := range transitions[from] {
+		if candidate == to {
+			return true
+		}
+	}
+	return false
+}
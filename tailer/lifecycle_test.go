@@ -0,0 +1,68 @@
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleValidTransitions(t *testing.T) {
+	lc := newLifecycle()
+	start := time.Now().UTC()
+
+	for i, phase := range []Phase{PhaseRegistered, PhaseAwaitingContainer, PhaseStreaming, PhaseReady, PhaseShuttingDown} {
+		require.NoError(t, lc.enter(phase, start.Add(time.Duration(i)*time.Second)))
+	}
+
+	require.Equal(t, PhaseShuttingDown, lc.phase)
+	history := lc.history()
+	require.Len(t, history, 5)
+	require.Equal(t, start.Add(2*time.Second), history[PhaseStreaming])
+}
+
+func TestLifecycleInvalidTransitions(t *testing.T) {
+	lc := newLifecycle()
+	now := time.Now().UTC()
+
+	// must register before doing anything else
+	require.Error(t, lc.enter(PhaseStreaming, now))
+	require.NoError(t, lc.enter(PhaseRegistered, now))
+
+	// can't become ready without a log stream
+	require.Error(t, lc.enter(PhaseReady, now))
+	require.Equal(t, PhaseRegistered, lc.phase)
+
+	require.NoError(t, lc.enter(PhaseFailed, now))
+	require.Error(t, lc.enter(PhaseReady, now))
+	require.NoError(t, lc.enter(PhaseShuttingDown, now))
+
+	// shutting down is terminal
+	require.Error(t, lc.enter(PhaseRegistered, now))
+}
+
+func TestLifecycleHistoryIsACopy(t *testing.T) {
+	lc := newLifecycle()
+	require.NoError(t, lc.enter(PhaseRegistered, time.Now()))
+
+	history := lc.history()
+	delete(history, PhaseRegistered)
+
+	require.Len(t, lc.history(), 1)
+}
+
+func TestLifecycleCrash(t *testing.T) {
+	lc := newLifecycle()
+	now := time.Now().UTC()
+
+	for _, phase := range []Phase{PhaseRegistered, PhaseAwaitingContainer, PhaseStreaming, PhaseReady} {
+		require.NoError(t, lc.enter(phase, now))
+	}
+	require.Error(t, lc.enter(PhaseFailed, now))
+
+	// a crash fails the tailer from any phase
+	crashed := now.Add(time.Second)
+	lc.crash(crashed)
+	require.Equal(t, PhaseFailed, lc.phase)
+	require.Equal(t, crashed, lc.history()[PhaseFailed])
+}
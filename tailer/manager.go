@@ -0,0 +1,369 @@
+package tailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/elireisman/whalewatcher/config"
+
+	docker "github.com/docker/docker/client"
+)
+
+// owns the tailer for each monitored target: starts, stops and restarts them,
+// reports on them, and waits for them all to drain on shutdown
+type Manager struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	client       docker.APIClient
+	disco        *Discovery
+	pub          *Publisher
+	awaitStartup time.Duration
+	logger       *log.Logger
+
+	lock    *sync.Mutex
+	targets map[string]*managedTarget
+
+	// the desired targets: those in the static config, those discovered from
+	// container labels, and those started directly. static config takes precedence
+	static  map[string]config.Container
+	labeled map[string]labeledTarget
+	adhoc   map[string]config.Container
+}
+
+// a target configured by the labels on the container with the given ID
+type labeledTarget struct {
+	id   string
+	conf config.Container
+}
+
+// a Tailer, or a ReplicaSet for targets that select several containers
+type monitor interface {
+	Start()
+
+	// publish the target as failed, moving it through its lifecycle
+	fail(msg string)
+}
+
+// a target's tailer, the config it was built from, and the means to stop it
+type managedTarget struct {
+	conf      config.Container
+	cancel    context.CancelFunc
+	startedAt time.Time
+
+	// finishedAt is written once, before done is closed
+	done       chan struct{}
+	finishedAt time.Time
+}
+
+// a managed target, as reported by Manager.Targets
+type TargetInfo struct {
+	Name       string           `json:"name"`
+	Config     config.Container `json:"-"`
+	Running    bool             `json:"running"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+}
+
+// obtain a Manager; its tailers are all stopped when ctx is canceled
+func NewManager(ctx context.Context, client docker.APIClient, disco *Discovery, pub *Publisher, awaitStartup time.Duration) *Manager {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &Manager{
+		ctx:          ctx,
+		cancel:       cancel,
+		client:       client,
+		disco:        disco,
+		pub:          pub,
+		awaitStartup: awaitStartup,
+		logger:       log.New(os.Stdout, "[manager] ", log.LstdFlags),
+		lock:         &sync.Mutex{},
+		targets:      map[string]*managedTarget{},
+		static:       map[string]config.Container{},
+		labeled:      map[string]labeledTarget{},
+		adhoc:        map[string]config.Container{},
+	}
+}
+
+// replace the static config, then start tailers for new targets, stop those for
+// removed targets, and restart those whose configuration changed. targets that
+// didn't change are untouched
+func (m *Manager) Apply(conf *config.Config) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.static = conf.Containers
+	m.pub.SetGroups(conf.Groups)
+	return m.reconcile()
+}
+
+// register a target for each container carrying whalewatcher labels as it starts,
+// and unregister it when the container is removed. labeled targets are merged with
+// the static config, which wins if both name the same container. caller should
+// execute this in a goroutine; returns when the Manager is shut down
+func (m *Manager) DiscoverLabeled(defaults config.Defaults) {
+	sub := m.disco.Subscribe(func(info ContainerInfo) bool {
+		return config.HasLabels(info.Labels)
+	})
+	defer sub.Close()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case evt := <-sub.Events:
+			m.labelsChanged(evt, defaults)
+		}
+	}
+}
+
+func (m *Manager) labelsChanged(evt ContainerEvent, defaults config.Defaults) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	info := evt.Container
+	switch evt.Action {
+	case ActionStart:
+		target, err := config.FromLabels(info.Labels)
+		if err != nil {
+			m.logger.Printf("WARN ignoring labels on container %s: %s", info.Name, err)
+			return
+		}
+		labeled := config.Config{Containers: map[string]config.Container{info.Name: target}}
+		labeled.ApplyDefaults(defaults)
+
+		if _, ok := m.static[info.Name]; ok {
+			m.logger.Printf("INFO container %s has labels, but static config takes precedence", info.Name)
+		}
+		m.labeled[info.Name] = labeledTarget{id: info.ID, conf: labeled.Containers[info.Name]}
+
+	case ActionRename:
+		for name, lt := range m.labeled {
+			if lt.id == info.ID {
+				delete(m.labeled, name)
+				m.labeled[info.Name] = lt
+			}
+		}
+
+	case ActionDestroy:
+		if lt, ok := m.labeled[info.Name]; !ok || lt.id != info.ID {
+			return
+		}
+		delete(m.labeled, info.Name)
+
+	default:
+		// an exited container remains a target, its tailer reports the exit
+		return
+	}
+
+	if err := m.reconcile(); err != nil {
+		m.logger.Printf("ERROR failed to apply container labels: %s", err)
+	}
+}
+
+// the static config merged over the directly started and labeled targets
+func (m *Manager) desired() map[string]config.Container {
+	out := make(map[string]config.Container, len(m.static)+len(m.labeled)+len(m.adhoc))
+	for name, lt := range m.labeled {
+		out[name] = lt.conf
+	}
+	for name, target := range m.adhoc {
+		out[name] = target
+	}
+	for name, target := range m.static {
+		out[name] = target
+	}
+	return out
+}
+
+// bring the running tailers in line with the desired targets. caller must hold the lock
+func (m *Manager) reconcile() error {
+	desired := m.desired()
+	m.pub.SetDependencies((&config.Config{Containers: desired}).Dependencies())
+
+	names := make([]string, 0, len(m.targets)+len(desired))
+	for name := range m.targets {
+		if _, ok := desired[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		target, wanted := desired[name]
+		current, managed := m.targets[name]
+
+		switch {
+		case managed && !wanted:
+			m.logger.Printf("INFO target %s removed, stopping", name)
+			m.halt(name)
+			m.pub.Remove(name)
+
+		case managed && reflect.DeepEqual(current.conf, target):
+			continue
+
+		case managed:
+			m.logger.Printf("INFO target %s config changed, restarting", name)
+			m.halt(name)
+			if err := m.launch(name, target); err != nil {
+				return err
+			}
+
+		default:
+			if err := m.launch(name, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// begin monitoring a new target, outside of the static or labeled config
+func (m *Manager) Start(name string, target config.Container) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.targets[name]; ok {
+		return fmt.Errorf("target %s is already managed", name)
+	}
+
+	if err := m.launch(name, target); err != nil {
+		return err
+	}
+	m.adhoc[name] = target
+	return nil
+}
+
+// stop monitoring a target, and unregister it from the Publisher. a target from
+// the static config or labels resumes the next time either of those changes
+func (m *Manager) Stop(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.targets[name]; !ok {
+		return fmt.Errorf("target %s is not managed", name)
+	}
+
+	delete(m.adhoc, name)
+	m.halt(name)
+	m.pub.Remove(name)
+	return nil
+}
+
+// stop a target's tailer, if still running, and start a fresh one from the same config
+func (m *Manager) Restart(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	current, ok := m.targets[name]
+	if !ok {
+		return fmt.Errorf("target %s is not managed", name)
+	}
+
+	m.halt(name)
+	return m.launch(name, current.conf)
+}
+
+// report the managed targets, ordered by name
+func (m *Manager) Targets() []TargetInfo {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	out := make([]TargetInfo, 0, len(m.targets))
+	for name, mt := range m.targets {
+		info := TargetInfo{
+			Name:      name,
+			Config:    mt.conf,
+			Running:   true,
+			StartedAt: mt.startedAt,
+		}
+
+		select {
+		case <-mt.done:
+			finished := mt.finishedAt
+			info.Running = false
+			info.FinishedAt = &finished
+		default:
+		}
+
+		out = append(out, info)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// stop all tailers, blocking until every one of them has finished
+func (m *Manager) Shutdown() {
+	m.cancel()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, mt := range m.targets {
+		<-mt.done
+	}
+	m.logger.Printf("INFO all %d tailers drained", len(m.targets))
+}
+
+// build and start a tailer for the target. caller must hold the lock
+func (m *Manager) launch(name string, target config.Container) error {
+	ctx, cancel := context.WithCancel(m.ctx)
+
+	var mon monitor
+	var err error
+	if target.Replicated() {
+		mon, err = NewReplicaSet(ctx, m.client, m.disco, m.pub, name, target, m.awaitStartup)
+	} else {
+		mon, err = New(ctx, m.client, m.disco, m.pub, name, target, m.awaitStartup)
+	}
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to start monitoring target %s: %s", name, err)
+	}
+
+	mt := &managedTarget{
+		conf:      target,
+		cancel:    cancel,
+		startedAt: time.Now().UTC(),
+		done:      make(chan struct{}),
+	}
+	m.targets[name] = mt
+
+	go m.run(name, mon, mt)
+	return nil
+}
+
+// run the target's monitor to completion, publishing a panic as the target's error
+func (m *Manager) run(name string, mon monitor, mt *managedTarget) {
+	defer close(mt.done)
+	defer func() {
+		if r := recover(); r != nil {
+			msg := fmt.Sprintf("tailer panicked: %v", r)
+			m.logger.Printf("ERROR target %s %s", name, msg)
+			mon.fail(msg)
+		}
+
+		mt.finishedAt = time.Now().UTC()
+	}()
+
+	mon.Start()
+}
+
+// cancel a target's tailer and wait for it to finish, so its final status
+// can't overwrite the status of whatever replaces it. caller must hold the lock
+func (m *Manager) halt(name string) {
+	mt := m.targets[name]
+	mt.cancel()
+	<-mt.done
+	delete(m.targets, name)
+}
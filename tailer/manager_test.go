@@ -0,0 +1,210 @@
+package tailer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/elireisman/whalewatcher/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestManager(disco *Discovery, pub *Publisher) *Manager {
+	return NewManager(context.Background(), &fakeDocker{}, disco, pub, time.Minute)
+}
+
+func requirePhase(t *testing.T, pub *Publisher, name string, phase Phase) {
+	require.Eventually(t, func() bool {
+		return pub.Snapshot()[name].Phase == phase
+	}, time.Second, 5*time.Millisecond, "target %s never reached phase %s", name, phase)
+}
+
+func TestManagerApply(t *testing.T) {
+	pub := NewPublisher()
+	mgr := newTestManager(NewDiscovery(nil), pub)
+	defer mgr.Shutdown()
+
+	require.NoError(t, mgr.Apply(&config.Config{Containers: map[string]config.Container{
+		"foo": {Pattern: "foo"},
+		"bar": {Pattern: "bar"},
+		"baz": {Pattern: "baz"},
+	}}))
+	requirePhase(t, pub, "foo", PhaseAwaitingContainer)
+	requirePhase(t, pub, "bar", PhaseAwaitingContainer)
+	started := pub.Snapshot()["bar"].Entered[PhaseRegistered]
+
+	// foo is unchanged, bar is changed, baz is removed, and qux is new
+	require.NoError(t, mgr.Apply(&config.Config{Containers: map[string]config.Container{
+		"foo": {Pattern: "foo"},
+		"bar": {Pattern: "bar2"},
+		"qux": {Pattern: "qux"},
+	}}))
+
+	targets := mgr.Targets()
+	require.Len(t, targets, 3)
+	require.Equal(t, "bar", targets[0].Name)
+	require.Equal(t, "bar2", targets[0].Config.Pattern)
+	require.Equal(t, "foo", targets[1].Name)
+	require.Equal(t, "qux", targets[2].Name)
+	for _, target := range targets {
+		require.True(t, target.Running)
+	}
+
+	_, ok := pub.Snapshot()["baz"]
+	require.False(t, ok)
+	requirePhase(t, pub, "bar", PhaseAwaitingContainer)
+	require.True(t, pub.Snapshot()["bar"].Entered[PhaseRegistered].After(started))
+}
+
+func TestManagerApplyInvalidTarget(t *testing.T) {
+	mgr := newTestManager(NewDiscovery(nil), NewPublisher())
+	defer mgr.Shutdown()
+
+	err := mgr.Apply(&config.Config{Containers: map[string]config.Container{
+		"foo": {Pattern: "foo", Since: "bogus"},
+	}})
+	require.Error(t, err)
+	require.Empty(t, mgr.Targets())
+}
+
+func TestManagerStartStopRestart(t *testing.T) {
+	pub := NewPublisher()
+	mgr := newTestManager(NewDiscovery(nil), pub)
+	defer mgr.Shutdown()
+
+	require.NoError(t, mgr.Start("foo", config.Container{Pattern: "foo"}))
+	require.Error(t, mgr.Start("foo", config.Container{Pattern: "foo"}))
+	requirePhase(t, pub, "foo", PhaseAwaitingContainer)
+
+	require.NoError(t, mgr.Restart("foo"))
+	requirePhase(t, pub, "foo", PhaseAwaitingContainer)
+	require.Len(t, mgr.Targets(), 1)
+
+	require.NoError(t, mgr.Stop("foo"))
+	require.Empty(t, mgr.Targets())
+	_, ok := pub.Snapshot()["foo"]
+	require.False(t, ok)
+
+	require.Error(t, mgr.Stop("foo"))
+	require.Error(t, mgr.Restart("foo"))
+}
+
+func TestManagerShutdownDrainsTailers(t *testing.T) {
+	pub := NewPublisher()
+	mgr := newTestManager(NewDiscovery(nil), pub)
+
+	require.NoError(t, mgr.Start("foo", config.Container{Pattern: "foo"}))
+	require.NoError(t, mgr.Start("bar", config.Container{Pattern: "bar"}))
+	requirePhase(t, pub, "foo", PhaseAwaitingContainer)
+	requirePhase(t, pub, "bar", PhaseAwaitingContainer)
+
+	mgr.Shutdown()
+
+	// every tailer has published its final status by the time Shutdown returns
+	for name, status := range pub.Snapshot() {
+		require.Equal(t, PhaseShuttingDown, status.Phase, name)
+	}
+	for _, target := range mgr.Targets() {
+		require.False(t, target.Running)
+		require.NotNil(t, target.FinishedAt)
+	}
+}
+
+// a tailer that crashes after moving through the given phases
+type panickingMonitor struct {
+	*Tailer
+	phases []Phase
+}
+
+func (m panickingMonitor) Start() {
+	for _, phase := range m.phases {
+		m.transition(phase, Status{})
+	}
+	panic("boom")
+}
+
+func TestManagerSurfacesPanics(t *testing.T) {
+	for _, phases := range [][]Phase{
+		{PhaseAwaitingContainer},
+		// failed isn't otherwise reachable from ready, but a crash always is
+		{PhaseAwaitingContainer, PhaseStreaming, PhaseReady},
+	} {
+		pub := NewPublisher()
+		mgr := newTestManager(NewDiscovery(nil), pub)
+
+		target := config.Container{Pattern: "foo", Mode: config.ModeContinuous}
+		tailer, err := New(mgr.ctx, mgr.client, mgr.disco, pub, "foo", target, time.Minute)
+		require.NoError(t, err)
+
+		mt := &managedTarget{conf: target, cancel: func() {}, startedAt: time.Now().UTC(), done: make(chan struct{})}
+		mgr.lock.Lock()
+		mgr.targets["foo"] = mt
+		mgr.lock.Unlock()
+		go mgr.run("foo", panickingMonitor{Tailer: tailer, phases: phases}, mt)
+
+		requirePhase(t, pub, "foo", PhaseFailed)
+
+		// the failure is recorded in the tailer's lifecycle like any other
+		status := pub.Snapshot()["foo"]
+		require.False(t, status.Ready)
+		require.Equal(t, "tailer panicked: boom", status.Error)
+		for _, phase := range append(phases, PhaseRegistered, PhaseFailed) {
+			require.Contains(t, status.Entered, phase)
+		}
+
+		require.Eventually(t, func() bool {
+			return !mgr.Targets()[0].Running
+		}, time.Second, 5*time.Millisecond)
+		mgr.Shutdown()
+	}
+}
+
+func TestManagerDiscoversLabeledTargets(t *testing.T) {
+	pub := NewPublisher()
+	disco := NewDiscovery(nil)
+	mgr := newTestManager(disco, pub)
+	defer mgr.Shutdown()
+
+	require.NoError(t, mgr.Apply(&config.Config{Containers: map[string]config.Container{
+		"bar": {Pattern: "static"},
+	}}))
+	go mgr.DiscoverLabeled(config.Defaults{OnTimeout: config.OnTimeoutError})
+
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true, Labels: map[string]string{
+		"whalewatcher.pattern": "labeled",
+	}})
+	disco.started(ContainerInfo{ID: "def", Name: "bar", Running: true, Labels: map[string]string{
+		"whalewatcher.pattern": "labeled",
+	}})
+	disco.started(ContainerInfo{ID: "ghi", Name: "baz", Running: true, Labels: map[string]string{
+		"whalewatcher.since": "10m",
+	}})
+	require.Eventually(t, func() bool {
+		_, ok := pub.Snapshot()["foo"]
+		return ok
+	}, time.Second, 5*time.Millisecond)
+
+	targets := mgr.Targets()
+	require.Len(t, targets, 2)
+	require.Equal(t, "bar", targets[0].Name)
+	require.Equal(t, "static", targets[0].Config.Pattern)
+	require.Equal(t, "foo", targets[1].Name)
+	require.Equal(t, "labeled", targets[1].Config.Pattern)
+	require.Equal(t, config.OnTimeoutError, targets[1].Config.OnTimeout)
+
+	// the labeled target outlives its container's exit, but not its removal
+	disco.stopped("abc", ActionDie)
+	disco.stopped("abc", ActionDestroy)
+	require.Eventually(t, func() bool {
+		_, ok := pub.Snapshot()["foo"]
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+	require.Len(t, mgr.Targets(), 1)
+
+	// static config still wins once the labeled container is gone
+	disco.stopped("def", ActionDestroy)
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, mgr.Targets(), 1)
+	require.Equal(t, "bar", mgr.Targets()[0].Name)
+}
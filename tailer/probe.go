@@ -0,0 +1,505 @@
+package tailer
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elireisman/whalewatcher/config"
+
+	docker_types "github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+)
+
+// kinds of probe, keying each probe's status in a target's Status
+const (
+	ProbeTCP  = "tcp"
+	ProbeHTTP = "http"
+	ProbeExec = "exec"
+	ProbeFile = "file"
+
+	ProbeHealthcheck = "healthcheck"
+)
+
+const (
+	// most of a response read when checking it against a probe's pattern
+	maxProbeResponse = 64 * 1024
+
+	// most of a response reported in a probe's status
+	maxProbeSnippet = 256
+)
+
+// the outcome of a target's most recent probe attempt
+type ProbeStatus struct {
+	OK    bool       `json:"ok"`
+	At    *time.Time `json:"at,omitempty"`
+	Error string     `json:"error,omitempty"`
+
+	// the number of consecutive failed attempts, how long the latest attempt
+	// took, and the start of its response, if the probe produces one
+	Failures      int    `json:"failures,omitempty"`
+	LatencyMillis int64  `json:"latency_millis"`
+	Response      string `json:"response,omitempty"`
+}
+
+// a readiness check run repeatedly against the target container while it starts
+type probe struct {
+	kind     string
+	interval time.Duration
+	timeout  time.Duration
+
+	// a single attempt against the container with the given ID, returning
+	// its response (if any) for the status
+	check func(ctx context.Context, id string) (string, error)
+}
+
+// one probe attempt's outcome, as delivered to the tailer
+type probeResult struct {
+	kind   string
+	status ProbeStatus
+}
+
+// build the probes configured for a target
+func buildProbes(client docker.APIClient, target config.Container, logger *log.Logger) ([]*probe, error) {
+	probes := []*probe{}
+
+	if target.TCPProbe != nil {
+		p, err := newTCPProbe(client, *target.TCPProbe)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tcp_probe: %s", err)
+		}
+		probes = append(probes, p)
+	}
+
+	if target.HTTPProbe != nil {
+		p, err := newHTTPProbe(client, *target.HTTPProbe)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http_probe: %s", err)
+		}
+		probes = append(probes, p)
+	}
+
+	if target.ExecProbe != nil {
+		p, err := newExecProbe(client, *target.ExecProbe)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exec_probe: %s", err)
+		}
+		probes = append(probes, p)
+	}
+
+	if target.FileProbe != nil {
+		p, err := newFileProbe(client, *target.FileProbe)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file_probe: %s", err)
+		}
+		probes = append(probes, p)
+	}
+
+	if target.UsesHealthcheck() {
+		probes = append(probes, newHealthcheckProbe(client, target.HealthcheckDefaulted(), logger))
+	}
+
+	return probes, nil
+}
+
+// run each probe against the container on its interval until ctx is canceled,
+// delivering the outcome of every attempt. the channel is nil without probes
+func runProbes(ctx context.Context, probes []*probe, id string) <-chan probeResult {
+	if len(probes) == 0 {
+		return nil
+	}
+
+	results := make(chan probeResult)
+	for _, p := range probes {
+		go p.run(ctx, id, results)
+	}
+	return results
+}
+
+func (p *probe) run(ctx context.Context, id string, results chan<- probeResult) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		res := p.attempt(ctx, id)
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case results <- res:
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// run the probe once against the container, within its timeout
+func (p *probe) attempt(ctx context.Context, id string) probeResult {
+	start := time.Now()
+	attemptCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	response, err := p.check(attemptCtx, id)
+	cancel()
+
+	now := time.Now().UTC()
+	res := probeResult{kind: p.kind, status: ProbeStatus{
+		OK:            err == nil,
+		At:            &now,
+		LatencyMillis: now.Sub(start).Nanoseconds() / int64(time.Millisecond),
+		Response:      snippet(response),
+	}}
+	if err != nil {
+		res.status.Error = err.Error()
+	}
+	return res
+}
+
+// a probe that opens (and immediately closes) a TCP connection to the target
+func newTCPProbe(client docker.APIClient, conf config.TCPProbe) (*probe, error) {
+	interval, timeout, err := conf.Durations()
+	if err != nil {
+		return nil, err
+	}
+
+	return &probe{
+		kind:     ProbeTCP,
+		interval: interval,
+		timeout:  timeout,
+		check: func(ctx context.Context, id string) (string, error) {
+			addr := conf.Address
+			if len(addr) == 0 {
+				host, err := containerAddress(ctx, client, id)
+				if err != nil {
+					return "", err
+				}
+				addr = net.JoinHostPort(host, strconv.Itoa(conf.Port))
+			}
+
+			conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return "", err
+			}
+			return "", conn.Close()
+		},
+	}, nil
+}
+
+// a probe that makes an HTTP request to the target, checking the response
+// code and optionally the body
+func newHTTPProbe(client docker.APIClient, conf config.HTTPProbe) (*probe, error) {
+	interval, timeout, err := conf.Durations()
+	if err != nil {
+		return nil, err
+	}
+	body, err := regexp.Compile(conf.BodyPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body_pattern %q: %s", conf.BodyPattern, err)
+	}
+	method := conf.Method
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+	// redirects are reported as the probe's response rather than followed
+	httpClient := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	return &probe{
+		kind:     ProbeHTTP,
+		interval: interval,
+		timeout:  timeout,
+		check: func(ctx context.Context, id string) (string, error) {
+			target := conf.URL
+			if len(target) == 0 {
+				host, err := containerAddress(ctx, client, id)
+				if err != nil {
+					return "", err
+				}
+				target = "http://" + net.JoinHostPort(host, strconv.Itoa(conf.Port)) + conf.Path
+			}
+
+			req, err := http.NewRequest(method, target, nil)
+			if err != nil {
+				return "", err
+			}
+			for name, value := range conf.Headers {
+				if strings.EqualFold(name, "Host") {
+					req.Host = value
+					continue
+				}
+				req.Header.Set(name, value)
+			}
+
+			resp, err := httpClient.Do(req.WithContext(ctx))
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+
+			raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProbeResponse))
+			if err != nil {
+				return "", fmt.Errorf("failed to read response: %s", err)
+			}
+			response := string(raw)
+
+			if !expectedStatus(resp.StatusCode, conf.ExpectedStatus) {
+				return response, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+			}
+			if !body.MatchString(response) {
+				return response, fmt.Errorf("response body did not match %q", body)
+			}
+			return response, nil
+		},
+	}, nil
+}
+
+// a probe that runs a command inside the target container through the exec API,
+// checking its exit code and optionally its output
+func newExecProbe(client docker.APIClient, conf config.ExecProbe) (*probe, error) {
+	interval, timeout, err := conf.Durations()
+	if err != nil {
+		return nil, err
+	}
+	output, err := regexp.Compile(conf.OutputPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output_pattern %q: %s", conf.OutputPattern, err)
+	}
+	command := strings.Join(conf.Command, " ")
+
+	return &probe{
+		kind:     ProbeExec,
+		interval: interval,
+		timeout:  timeout,
+		check: func(ctx context.Context, id string) (string, error) {
+			exec, err := client.ContainerExecCreate(ctx, id, docker_types.ExecConfig{
+				Cmd:          conf.Command,
+				AttachStdout: true,
+				AttachStderr: true,
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to create exec: %s", err)
+			}
+
+			attached, err := client.ContainerExecAttach(ctx, exec.ID, docker_types.ExecStartCheck{})
+			if err != nil {
+				return "", fmt.Errorf("failed to start exec: %s", err)
+			}
+			defer attached.Close()
+
+			// the hijacked connection ignores ctx, so close it if the attempt times out
+			finished := make(chan struct{})
+			defer close(finished)
+			go func() {
+				select {
+				case <-ctx.Done():
+					attached.Close()
+				case <-finished:
+				}
+			}()
+
+			lines, size := []string{}, 0
+			err = demuxLines(attached.Reader, func(line string) error {
+				if size < maxProbeResponse {
+					lines = append(lines, line)
+					size += len(line) + 1
+				}
+				return nil
+			})
+			response := strings.Join(lines, "\n")
+			if err != nil {
+				if ctx.Err() != nil {
+					return response, fmt.Errorf("command %q did not finish: %s", command, ctx.Err())
+				}
+				return response, fmt.Errorf("failed to read command output: %s", err)
+			}
+
+			result, err := client.ContainerExecInspect(ctx, exec.ID)
+			if err != nil {
+				return response, fmt.Errorf("failed to inspect exec: %s", err)
+			}
+			switch {
+			case result.Running:
+				return response, fmt.Errorf("command %q did not finish", command)
+			case result.ExitCode != 0:
+				return response, fmt.Errorf("command %q exited with code %d", command, result.ExitCode)
+			case !output.MatchString(response):
+				return response, fmt.Errorf("command output did not match %q", output)
+			}
+			return response, nil
+		},
+	}, nil
+}
+
+// a probe that checks for a file inside the target container through the
+// archive API, fetching its contents only if they must match a pattern
+func newFileProbe(client docker.APIClient, conf config.FileProbe) (*probe, error) {
+	interval, timeout, err := conf.Durations()
+	if err != nil {
+		return nil, err
+	}
+	var content *regexp.Regexp
+	if len(conf.ContentPattern) > 0 {
+		if content, err = regexp.Compile(conf.ContentPattern); err != nil {
+			return nil, fmt.Errorf("invalid content_pattern %q: %s", conf.ContentPattern, err)
+		}
+	}
+
+	return &probe{
+		kind:     ProbeFile,
+		interval: interval,
+		timeout:  timeout,
+		check: func(ctx context.Context, id string) (string, error) {
+			if content == nil {
+				if _, err := client.ContainerStatPath(ctx, id, conf.Path); err != nil {
+					return "", fileError(conf.Path, err)
+				}
+				return "", nil
+			}
+
+			archive, _, err := client.CopyFromContainer(ctx, id, conf.Path)
+			if err != nil {
+				return "", fileError(conf.Path, err)
+			}
+			defer archive.Close()
+
+			// the file arrives as the only entry in a tar archive
+			entries := tar.NewReader(archive)
+			header, err := entries.Next()
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %s", conf.Path, err)
+			}
+			if header.Typeflag == tar.TypeDir {
+				return "", fmt.Errorf("%s is a directory", conf.Path)
+			}
+
+			raw, err := ioutil.ReadAll(io.LimitReader(entries, maxProbeResponse))
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %s", conf.Path, err)
+			}
+			response := string(raw)
+
+			if !content.MatchString(response) {
+				return response, fmt.Errorf("contents of %s did not match %q", conf.Path, content)
+			}
+			return response, nil
+		},
+	}, nil
+}
+
+// describe a failure to find a probed file
+func fileError(path string, err error) error {
+	if docker.IsErrNotFound(err) {
+		return fmt.Errorf("%s does not exist", path)
+	}
+	return fmt.Errorf("failed to find %s: %s", path, err)
+}
+
+// a probe that reports the status of the container's own HEALTHCHECK, with
+// the output of its latest check. a container without a healthcheck fails,
+// unless the probe only applies by default, when it passes with a warning
+func newHealthcheckProbe(client docker.APIClient, defaulted bool, logger *log.Logger) *probe {
+	warn := &sync.Once{}
+
+	return &probe{
+		kind:     ProbeHealthcheck,
+		interval: config.DefaultProbeInterval,
+		timeout:  config.DefaultProbeTimeout,
+		check: func(ctx context.Context, id string) (string, error) {
+			info, err := client.ContainerInspect(ctx, id)
+			if err != nil {
+				return "", fmt.Errorf("failed to inspect container %s: %s", id, err)
+			}
+			if info.ContainerJSONBase == nil || info.State == nil || info.State.Health == nil {
+				if !defaulted {
+					return "", fmt.Errorf("container has no healthcheck, but use_healthcheck is set")
+				}
+				warn.Do(func() {
+					logger.Printf("WARN container %s has no healthcheck, ignoring --use-healthcheck", id)
+				})
+				return "container has no healthcheck", nil
+			}
+
+			health := info.State.Health
+			output := ""
+			if n := len(health.Log); n > 0 && health.Log[n-1] != nil {
+				output = strings.TrimSpace(health.Log[n-1].Output)
+			}
+
+			switch health.Status {
+			case docker_types.Healthy:
+				return output, nil
+			case docker_types.Unhealthy:
+				return output, fmt.Errorf("container is unhealthy after %d failed checks", health.FailingStreak)
+			}
+			return output, fmt.Errorf("container health is %s", health.Status)
+		},
+	}
+}
+
+// report whether an HTTP response code passes the probe: one of those
+// expected, or without any expected, any 2xx code
+func expectedStatus(code int, expected []int) bool {
+	if len(expected) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, candidate := range expected {
+		if code == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// trim a probe's response for its status
+func snippet(response string) string {
+	if len(response) > maxProbeSnippet {
+		return response[:maxProbeSnippet]
+	}
+	return response
+}
+
+// resolve the container's IP address from its network settings, preferring
+// the first of its networks by name that assigned it one
+func containerAddress(ctx context.Context, client docker.APIClient, id string) (string, error) {
+	info, err := client.ContainerInspect(ctx, id)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container %s: %s", id, err)
+	}
+	if info.NetworkSettings == nil {
+		return "", fmt.Errorf("container %s has no network settings", id)
+	}
+
+	names := make([]string, 0, len(info.NetworkSettings.Networks))
+	for name := range info.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if endpoint := info.NetworkSettings.Networks[name]; endpoint != nil && len(endpoint.IPAddress) > 0 {
+			return endpoint.IPAddress, nil
+		}
+	}
+	if len(info.NetworkSettings.IPAddress) > 0 {
+		return info.NetworkSettings.IPAddress, nil
+	}
+
+	return "", fmt.Errorf("container %s has no network address", id)
+}
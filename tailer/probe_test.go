@@ -0,0 +1,425 @@
+package tailer
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elireisman/whalewatcher/config"
+
+	docker_types "github.com/docker/docker/api/types"
+	docker_network "github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/require"
+)
+
+func (f *fakeDocker) ContainerExecCreate(ctx context.Context, id string, conf docker_types.ExecConfig) (docker_types.IDResponse, error) {
+	if _, ok := f.containers[id]; !ok {
+		return docker_types.IDResponse{}, fmt.Errorf("no such container: %s", id)
+	}
+	f.execCmd = conf.Cmd
+	return docker_types.IDResponse{ID: "exec-" + id}, nil
+}
+
+// serves the exec's output as a single multiplexed stdout frame
+func (f *fakeDocker) ContainerExecAttach(ctx context.Context, execID string, check docker_types.ExecStartCheck) (docker_types.HijackedResponse, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		header := make([]byte, frameHeaderLen)
+		header[0] = streamStdout
+		binary.BigEndian.PutUint32(header[4:], uint32(len(f.execOutput)))
+		server.Write(append(header, f.execOutput...))
+	}()
+	return docker_types.HijackedResponse{Conn: client, Reader: bufio.NewReader(client)}, nil
+}
+
+func (f *fakeDocker) ContainerExecInspect(ctx context.Context, execID string) (docker_types.ContainerExecInspect, error) {
+	return docker_types.ContainerExecInspect{ExecID: execID, ExitCode: f.execCode}, nil
+}
+
+func (f *fakeDocker) ContainerStatPath(ctx context.Context, id, path string) (docker_types.ContainerPathStat, error) {
+	contents, ok := f.files[path]
+	if !ok {
+		return docker_types.ContainerPathStat{}, errdefs.NotFound(fmt.Errorf("Could not find the file %s in container %s", path, id))
+	}
+	return docker_types.ContainerPathStat{Name: filepath.Base(path), Size: int64(len(contents))}, nil
+}
+
+// serves the file as the only entry in a tar archive
+func (f *fakeDocker) CopyFromContainer(ctx context.Context, id, path string) (io.ReadCloser, docker_types.ContainerPathStat, error) {
+	stat, err := f.ContainerStatPath(ctx, id, path)
+	if err != nil {
+		return nil, stat, err
+	}
+
+	buf := &bytes.Buffer{}
+	archive := tar.NewWriter(buf)
+	archive.WriteHeader(&tar.Header{Name: stat.Name, Mode: 0644, Size: stat.Size, Typeflag: tar.TypeReg})
+	archive.Write([]byte(f.files[path]))
+	archive.Close()
+
+	return ioutil.NopCloser(buf), stat, nil
+}
+
+func passed(kind string) probeResult {
+	now := time.Now().UTC()
+	return probeResult{kind: kind, status: ProbeStatus{OK: true, At: &now}}
+}
+
+func TestTCPProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	p, err := newTCPProbe(nil, config.TCPProbe{Address: listener.Addr().String()})
+	require.NoError(t, err)
+	_, err = p.check(context.TODO(), "abc")
+	require.NoError(t, err)
+
+	addr := listener.Addr().String()
+	listener.Close()
+	p, err = newTCPProbe(nil, config.TCPProbe{Address: addr})
+	require.NoError(t, err)
+	_, err = p.check(context.TODO(), "abc")
+	require.Error(t, err)
+}
+
+func TestTCPProbeResolvesContainerPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	info := runningContainer("abc")
+	info.NetworkSettings = &docker_types.NetworkSettings{Networks: map[string]*docker_network.EndpointSettings{
+		"bridge":       {},
+		"demo_default": {IPAddress: "127.0.0.1"},
+	}}
+	client := &fakeDocker{containers: map[string]docker_types.ContainerJSON{"abc": info}}
+
+	p, err := newTCPProbe(client, config.TCPProbe{Port: listener.Addr().(*net.TCPAddr).Port})
+	require.NoError(t, err)
+	_, err = p.check(context.TODO(), "abc")
+	require.NoError(t, err)
+
+	// a container without an address can't be probed by port
+	client.containers["abc"] = runningContainer("abc")
+	_, err = p.check(context.TODO(), "abc")
+	require.Error(t, err)
+}
+
+func TestRunProbes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	p, err := newTCPProbe(nil, config.TCPProbe{
+		Address:     listener.Addr().String(),
+		ProbeTiming: config.ProbeTiming{Interval: "10ms"},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	results := runProbes(ctx, []*probe{p}, "abc")
+	for i := 0; i < 2; i++ {
+		res := <-results
+		require.Equal(t, ProbeTCP, res.kind)
+		require.True(t, res.status.OK)
+		require.Empty(t, res.status.Error)
+	}
+
+	require.Nil(t, runProbes(ctx, nil, "abc"))
+}
+
+func TestHTTPProbe(t *testing.T) {
+	healthy, accept := false, ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"status":"red"}`)
+			return
+		}
+		fmt.Fprint(w, `{"status":"green"}`)
+	}))
+	defer server.Close()
+
+	p, err := newHTTPProbe(nil, config.HTTPProbe{
+		URL:         server.URL + "/_cluster/health",
+		Headers:     map[string]string{"Accept": "application/json"},
+		BodyPattern: `"status":"(green|yellow)"`,
+	})
+	require.NoError(t, err)
+
+	response, err := p.check(context.TODO(), "abc")
+	require.EqualError(t, err, "unexpected response status 503")
+	require.Equal(t, `{"status":"red"}`, response)
+	require.Equal(t, "application/json", accept)
+
+	healthy = true
+	response, err = p.check(context.TODO(), "abc")
+	require.NoError(t, err)
+	require.Equal(t, `{"status":"green"}`, response)
+
+	// the expected codes and body are both checked
+	p, err = newHTTPProbe(nil, config.HTTPProbe{URL: server.URL + "/_cluster/health", ExpectedStatus: []int{204}})
+	require.NoError(t, err)
+	_, err = p.check(context.TODO(), "abc")
+	require.EqualError(t, err, "unexpected response status 200")
+
+	p, err = newHTTPProbe(nil, config.HTTPProbe{URL: server.URL + "/_cluster/health", BodyPattern: `"status":"green",`})
+	require.NoError(t, err)
+	_, err = p.check(context.TODO(), "abc")
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "response body did not match"))
+}
+
+func TestHTTPProbeResolvesContainerPort(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/ping" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	info := runningContainer("abc")
+	info.NetworkSettings = &docker_types.NetworkSettings{Networks: map[string]*docker_network.EndpointSettings{
+		"demo_default": {IPAddress: "127.0.0.1"},
+	}}
+	client := &fakeDocker{containers: map[string]docker_types.ContainerJSON{"abc": info}}
+
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	p, err := newHTTPProbe(client, config.HTTPProbe{Port: port, Path: "/ping", Method: http.MethodHead})
+	require.NoError(t, err)
+	_, err = p.check(context.TODO(), "abc")
+	require.NoError(t, err)
+}
+
+func TestExecProbe(t *testing.T) {
+	client := &fakeDocker{
+		containers: map[string]docker_types.ContainerJSON{"abc": runningContainer("abc")},
+		execOutput: "/var/run/postgresql:5432 - accepting connections\n",
+	}
+	p, err := newExecProbe(client, config.ExecProbe{
+		Command:       []string{"pg_isready", "-U", "postgres"},
+		OutputPattern: "accepting connections",
+	})
+	require.NoError(t, err)
+
+	response, err := p.check(context.TODO(), "abc")
+	require.NoError(t, err)
+	require.Equal(t, "/var/run/postgresql:5432 - accepting connections", response)
+	require.Equal(t, []string{"pg_isready", "-U", "postgres"}, client.execCmd)
+
+	client.execOutput = "/var/run/postgresql:5432 - rejecting connections\n"
+	_, err = p.check(context.TODO(), "abc")
+	require.EqualError(t, err, `command output did not match "accepting connections"`)
+
+	client.execOutput, client.execCode = "/var/run/postgresql:5432 - no response\n", 2
+	response, err = p.check(context.TODO(), "abc")
+	require.EqualError(t, err, `command "pg_isready -U postgres" exited with code 2`)
+	require.Equal(t, "/var/run/postgresql:5432 - no response", response)
+
+	_, err = p.check(context.TODO(), "def")
+	require.Error(t, err)
+}
+
+func TestFileProbe(t *testing.T) {
+	client := &fakeDocker{files: map[string]string{}}
+	exists, err := newFileProbe(client, config.FileProbe{Path: "/tmp/ready"})
+	require.NoError(t, err)
+	matches, err := newFileProbe(client, config.FileProbe{Path: "/tmp/ready", ContentPattern: `^migrations: done`})
+	require.NoError(t, err)
+
+	_, err = exists.check(context.TODO(), "abc")
+	require.EqualError(t, err, "/tmp/ready does not exist")
+	_, err = matches.check(context.TODO(), "abc")
+	require.EqualError(t, err, "/tmp/ready does not exist")
+
+	client.files["/tmp/ready"] = "migrations: pending\n"
+	_, err = exists.check(context.TODO(), "abc")
+	require.NoError(t, err)
+	response, err := matches.check(context.TODO(), "abc")
+	require.EqualError(t, err, `contents of /tmp/ready did not match "^migrations: done"`)
+	require.Equal(t, "migrations: pending\n", response)
+
+	client.files["/tmp/ready"] = "migrations: done\n"
+	_, err = matches.check(context.TODO(), "abc")
+	require.NoError(t, err)
+}
+
+// a running container whose healthcheck reports status, with output from its latest check
+func healthContainer(id, status, output string) docker_types.ContainerJSON {
+	info := runningContainer(id)
+	info.State.Health = &docker_types.Health{
+		Status:        status,
+		FailingStreak: 3,
+		Log:           []*docker_types.HealthcheckResult{{Output: "older\n"}, {Output: output + "\n"}},
+	}
+	return info
+}
+
+func TestHealthcheckProbe(t *testing.T) {
+	client := &fakeDocker{containers: map[string]docker_types.ContainerJSON{
+		"abc": healthContainer("abc", docker_types.Unhealthy, "Could not connect to Redis"),
+	}}
+	p := newHealthcheckProbe(client, false, log.New(ioutil.Discard, "", 0))
+
+	response, err := p.check(context.TODO(), "abc")
+	require.EqualError(t, err, "container is unhealthy after 3 failed checks")
+	require.Equal(t, "Could not connect to Redis", response)
+
+	client.containers["abc"] = healthContainer("abc", docker_types.Starting, "")
+	_, err = p.check(context.TODO(), "abc")
+	require.EqualError(t, err, "container health is starting")
+
+	client.containers["abc"] = healthContainer("abc", docker_types.Healthy, "PONG")
+	response, err = p.check(context.TODO(), "abc")
+	require.NoError(t, err)
+	require.Equal(t, "PONG", response)
+
+	// a target that asked for its HEALTHCHECK can't do without one
+	client.containers["abc"] = runningContainer("abc")
+	_, err = p.check(context.TODO(), "abc")
+	require.EqualError(t, err, "container has no healthcheck, but use_healthcheck is set")
+
+	// but with only --use-healthcheck, there's nothing to wait for
+	p = newHealthcheckProbe(client, true, log.New(ioutil.Discard, "", 0))
+	response, err = p.check(context.TODO(), "abc")
+	require.NoError(t, err)
+	require.Equal(t, "container has no healthcheck", response)
+}
+
+func TestHealthStatusEventReadiesTarget(t *testing.T) {
+	use := true
+	targetConf := config.Container{UseHealthcheck: &use}
+	pub := NewPublisher()
+	disco := NewDiscovery(nil)
+	client := &fakeDocker{containers: map[string]docker_types.ContainerJSON{
+		"abc": healthContainer("abc", docker_types.Starting, ""),
+	}}
+	tailer, err := New(context.TODO(), client, disco, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, config.ReadyWhenProbe, tailer.ReadyWhen)
+	requireStreaming(t, tailer)
+	tailer.ID = "abc"
+
+	require.False(t, tailer.probeNow(ProbeHealthcheck))
+	require.Equal(t, "container health is starting", pub.state["foo"].Probes[ProbeHealthcheck].Error)
+
+	client.containers["abc"] = healthContainer("abc", docker_types.Healthy, "")
+	require.True(t, tailer.probeNow(ProbeHealthcheck))
+	require.True(t, pub.state["foo"].Ready)
+	require.False(t, tailer.probeNow(ProbeTCP))
+}
+
+func TestProbeFailuresPublished(t *testing.T) {
+	targetConf := config.Container{ReadyWhen: config.ReadyWhenProbe, HTTPProbe: &config.HTTPProbe{Port: 9200}}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+
+	failed := probeResult{kind: ProbeHTTP, status: ProbeStatus{
+		Error:         "unexpected response status 503",
+		LatencyMillis: 12,
+		Response:      `{"status":"red"}`,
+	}}
+	require.False(t, tailer.probed(failed))
+	seq := pub.Sequence()
+
+	status := pub.state["foo"].Probes[ProbeHTTP]
+	require.Equal(t, 1, status.Failures)
+	require.Equal(t, int64(12), status.LatencyMillis)
+	require.Equal(t, `{"status":"red"}`, status.Response)
+
+	// the same failure again is counted, but not published until something changes
+	require.False(t, tailer.probed(failed))
+	require.Equal(t, seq, pub.Sequence())
+	require.Equal(t, 2, tailer.probeStatus[ProbeHTTP].Failures)
+
+	failed.status.Response = `{"status":"yellow"}`
+	require.False(t, tailer.probed(failed))
+	require.Equal(t, seq+1, pub.Sequence())
+	require.Equal(t, 3, pub.state["foo"].Probes[ProbeHTTP].Failures)
+
+	require.True(t, tailer.probed(passed(ProbeHTTP)))
+	require.True(t, pub.state["foo"].Ready)
+	require.Zero(t, pub.state["foo"].Probes[ProbeHTTP].Failures)
+}
+
+func TestProbeSnippet(t *testing.T) {
+	require.Equal(t, "short", snippet("short"))
+	require.Len(t, snippet(strings.Repeat("x", 2*maxProbeSnippet)), maxProbeSnippet)
+}
+
+func TestReadyWhenAll(t *testing.T) {
+	targetConf := config.Container{Pattern: `ready`, ReadyWhen: config.ReadyWhenAll, TCPProbe: &config.TCPProbe{Port: 80}}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+
+	// the log match alone isn't enough
+	require.False(t, tailer.ProcessLine(&Line{Text: "ready"}, 1))
+	require.False(t, pub.state["foo"].Ready)
+	require.True(t, pub.state["foo"].LogsMatched)
+
+	require.True(t, tailer.probed(passed(ProbeTCP)))
+	require.True(t, pub.state["foo"].Ready)
+	require.True(t, pub.state["foo"].Probes[ProbeTCP].OK)
+}
+
+func TestReadyWhenAny(t *testing.T) {
+	targetConf := config.Container{Pattern: `ready`, ReadyWhen: config.ReadyWhenAny, TCPProbe: &config.TCPProbe{Port: 80}}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+
+	require.False(t, tailer.probed(probeResult{kind: ProbeTCP, status: ProbeStatus{Error: "connection refused"}}))
+	require.Equal(t, PhaseStreaming, pub.state["foo"].Phase)
+	require.Equal(t, "connection refused", pub.state["foo"].Probes[ProbeTCP].Error)
+
+	require.True(t, tailer.ProcessLine(&Line{Text: "ready"}, 1))
+	require.True(t, pub.state["foo"].Ready)
+	require.False(t, pub.state["foo"].Probes[ProbeTCP].OK)
+}
+
+func TestReadyWhenProbe(t *testing.T) {
+	targetConf := config.Container{ReadyWhen: config.ReadyWhenProbe, TCPProbe: &config.TCPProbe{Port: 80}}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	require.Empty(t, tailer.Patterns)
+	requireStreaming(t, tailer)
+
+	require.False(t, tailer.ProcessLine(&Line{Text: "ready"}, 1))
+	require.True(t, tailer.probed(passed(ProbeTCP)))
+	require.True(t, pub.state["foo"].Ready)
+}
+
+func TestInvalidReadyWhen(t *testing.T) {
+	for _, targetConf := range []config.Container{
+		{Pattern: `ready`, ReadyWhen: "eventually"},
+		{Pattern: `ready`, ReadyWhen: config.ReadyWhenAll},
+		{ReadyWhen: config.ReadyWhenProbe, TCPProbe: &config.TCPProbe{Port: 80, ProbeTiming: config.ProbeTiming{Interval: "often"}}},
+	} {
+		_, err := New(context.TODO(), nil, nil, NewPublisher(), "foo", targetConf, time.Second)
+		require.Error(t, err)
+	}
+}
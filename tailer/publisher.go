@@ -1,14 +1,18 @@
 package tailer
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/elireisman/whalewatcher/config"
 )
 
 // status reported for each app
@@ -16,14 +20,225 @@ type Status struct {
 	Ready bool       `json:"ready"`
 	At    *time.Time `json:"at,omitempty"`
 	Error string     `json:"error"`
+
+	// set when the ready wait elapsed without a pattern match; if Ready
+	// is also set, readiness was inferred from the timeout
+	TimedOut bool `json:"timed_out,omitempty"`
+
+	// the log line that matched one of the target's failure patterns
+	Line string `json:"line,omitempty"`
+
+	// details of the target container's exit, if it stopped unexpectedly
+	Exit *ExitInfo `json:"exit,omitempty"`
+
+	// the container currently monitored, and the number of times the target
+	// was restarted under monitoring (only tracked in continuous mode)
+	ContainerID string `json:"container_id,omitempty"`
+	Restarts    int    `json:"restarts,omitempty"`
+
+	// the target's current lifecycle phase, and when each phase was entered
+	Phase   Phase               `json:"phase,omitempty"`
+	Entered map[Phase]time.Time `json:"entered,omitempty"`
+
+	// for replicated targets, the status of each replica keyed by container
+	// name, and the quorum of ready replicas the target's readiness requires
+	Replicas map[string]Status `json:"replicas,omitempty"`
+	Quorum   string            `json:"quorum,omitempty"`
+	MinReady int               `json:"min_ready,omitempty"`
+
+	// the chain of dependencies keeping this target from being ready, ending
+	// with the first one that isn't ready itself
+	BlockedBy []string `json:"blocked_by,omitempty"`
+
+	// for targets with probes, whether a log pattern has matched, and the
+	// latest result of each probe keyed by kind
+	LogsMatched bool                   `json:"logs_matched,omitempty"`
+	Probes      map[string]ProbeStatus `json:"probes,omitempty"`
+}
+
+// diagnostics captured when a target container exits
+type ExitInfo struct {
+	Code       int        `json:"code"`
+	OOMKilled  bool       `json:"oom_killed"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	LastLines  []string   `json:"last_lines,omitempty"`
+}
+
+// precedence of the HTTP status codes when aggregating multiple targets
+var statusRank = map[int]int{
+	http.StatusOK:                 0,
+	http.StatusAccepted:           1,
+	http.StatusGatewayTimeout:     2,
+	http.StatusServiceUnavailable: 3,
+}
+
+// the HTTP status code this target contributes to an aggregate response
+func (s Status) code() int {
+	// a replicated target's phase follows its quorum, unless a dependency overrides it
+	if len(s.Replicas) > 0 && s.Phase != PhaseFailed && s.Phase != PhaseTimedOut && s.Phase != PhaseBlocked {
+		return s.quorumCode()
+	}
+
+	switch s.Phase {
+	case PhaseReady:
+		return http.StatusOK
+	case PhaseTimedOut:
+		return http.StatusGatewayTimeout
+	case PhaseFailed, PhaseContainerExited, PhaseShuttingDown:
+		return http.StatusServiceUnavailable
+	case "":
+		// status published without a lifecycle phase, use the legacy fields
+		switch {
+		case len(s.Error) > 0:
+			return http.StatusServiceUnavailable
+		case s.Ready:
+			return http.StatusOK
+		case s.TimedOut:
+			return http.StatusGatewayTimeout
+		}
+	}
+
+	return http.StatusAccepted
+}
+
+// the number of ready replicas a replicated target requires. with the default
+// "all" quorum, replicas whose containers exited (but weren't yet removed) aren't
+// required, i.e. those stopped while scaling down
+func (s Status) required() int {
+	switch {
+	case s.MinReady > 0:
+		return s.MinReady
+	case s.Quorum == config.QuorumAny:
+		return 1
+	}
+
+	required := 0
+	for _, replica := range s.Replicas {
+		if replica.Phase != PhaseContainerExited {
+			required++
+		}
+	}
+	return required
+}
+
+// the aggregate code of a replicated target: ready once the quorum is ready,
+// and failed (or timed out) once too few of the known replicas remain to reach it
+func (s Status) quorumCode() int {
+	all := s.MinReady == 0 && s.Quorum != config.QuorumAny
+
+	counted, ready, failed, timedOut := 0, 0, 0, 0
+	for _, replica := range s.Replicas {
+		// an exited replica counts against a "all" quorum only by its absence
+		if all && replica.Phase == PhaseContainerExited {
+			continue
+		}
+
+		counted++
+		switch replica.code() {
+		case http.StatusOK:
+			ready++
+		case http.StatusServiceUnavailable:
+			failed++
+		case http.StatusGatewayTimeout:
+			timedOut++
+		}
+	}
+
+	// every replica exited, leaving none to be ready
+	if counted == 0 {
+		return http.StatusServiceUnavailable
+	}
+
+	required := s.required()
+	switch {
+	case ready >= required:
+		return http.StatusOK
+	case counted-failed-timedOut >= required:
+		return http.StatusAccepted
+	case failed > 0:
+		return http.StatusServiceUnavailable
+	case timedOut > 0:
+		return http.StatusGatewayTimeout
+	}
+
+	// no replica has settled short of ready, and more may yet be discovered
+	return http.StatusAccepted
 }
 
+// derive a replicated target's readiness and phase from its replicas. the phase
+// entry times carry over, adding the time at which any new phase is entered
+func (s *Status) aggregate(at time.Time) {
+	previous := s.Phase
+	s.Error = ""
+	defer s.entered(previous, at)
+
+	if len(s.Replicas) == 0 {
+		s.Replicas = nil
+		s.Ready = false
+		s.Phase = PhaseAwaitingContainer
+		return
+	}
+
+	code := s.quorumCode()
+	s.Ready = code == http.StatusOK
+
+	switch code {
+	case http.StatusOK:
+		s.Phase = PhaseReady
+	case http.StatusAccepted:
+		s.Phase = PhaseStreaming
+	case http.StatusGatewayTimeout:
+		s.Phase = PhaseTimedOut
+	default:
+		s.Phase = PhaseShuttingDown
+		for _, replica := range s.Replicas {
+			if replica.Phase != PhaseShuttingDown {
+				s.Phase = PhaseFailed
+				s.Error = fmt.Sprintf("quorum unreachable: %d of %d replicas required to be ready", s.required(), len(s.Replicas))
+				if s.required() == 0 {
+					s.Error = fmt.Sprintf("quorum unreachable: all %d replicas exited", len(s.Replicas))
+				}
+				break
+			}
+		}
+	}
+}
+
+// copy the phase entry times, so previously published events are left
+// untouched, recording at as the entry time if the phase changed
+func (s *Status) entered(previous Phase, at time.Time) {
+	entered := make(map[Phase]time.Time, len(s.Entered)+1)
+	for phase, when := range s.Entered {
+		entered[phase] = when
+	}
+	if _, ok := entered[s.Phase]; !ok || s.Phase != previous {
+		entered[s.Phase] = at
+	}
+	s.Entered = entered
+}
+
+// a status update for one registered app, as streamed to event subscribers.
+// Old is omitted when the app is first registered, and Removed is set
+// (with New left empty) when the app is no longer monitored
+type Event struct {
+	ID      uint64    `json:"id"`
+	Name    string    `json:"name"`
+	Old     *Status   `json:"old,omitempty"`
+	New     Status    `json:"new"`
+	Removed bool      `json:"removed,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// number of recent events retained so subscribers can resume after reconnecting
+const maxEventHistory = 1024
+
 // obtain a publisher
 func NewPublisher() *Publisher {
 	return &Publisher{
-		lock:   &sync.RWMutex{},
-		logger: log.New(os.Stdout, "[publisher] ", log.LstdFlags),
-		state:  map[string]Status{},
+		lock:    &sync.RWMutex{},
+		logger:  log.New(os.Stdout, "[publisher] ", log.LstdFlags),
+		state:   map[string]Status{},
+		changed: make(chan struct{}),
 	}
 }
 
@@ -34,6 +249,25 @@ type Publisher struct {
 	lock   *sync.RWMutex
 	logger *log.Logger
 	state  map[string]Status
+
+	// closed (and replaced) on every update to wake any waiters
+	changed chan struct{}
+
+	// monotonically increasing event sequence, and the most recent events
+	seq     uint64
+	history []Event
+
+	// the targets each target depends on, and the members of each named group
+	deps   map[string][]string
+	groups map[string][]string
+}
+
+// a target's place in the dependency graph, as reported by GetGraph
+type GraphNode struct {
+	DependsOn []string `json:"depends_on"`
+	Ready     bool     `json:"ready"`
+	Phase     Phase    `json:"phase,omitempty"`
+	BlockedBy []string `json:"blocked_by,omitempty"`
 }
 
 // Update status for a particular registered app
@@ -41,7 +275,392 @@ func (p *Publisher) Add(key string, evt Status) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
+	event := Event{Name: key, New: evt}
+	if old, ok := p.state[key]; ok {
+		event.Old = &old
+	}
 	p.state[key] = evt
+
+	p.record(event)
+}
+
+// Update the status of one replica of a replicated app, and the
+// app's aggregate status along with it
+func (p *Publisher) AddReplica(key, replica string, evt Status) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.updateReplicas(key, evt.At, func(replicas map[string]Status) {
+		replicas[replica] = evt
+	})
+}
+
+// Mark an app failed outright, keeping the replicas and phase entry times
+// of its last status. for a replicated app whose replicas are all stopped
+func (p *Publisher) Fail(key, msg string, at time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	event := Event{Name: key}
+	old, ok := p.state[key]
+	if ok {
+		event.Old = &old
+	}
+
+	status := old
+	status.Ready = false
+	status.Error = msg
+	status.At = &at
+	status.Phase = PhaseFailed
+	status.entered("", at)
+
+	p.state[key] = status
+	event.New = status
+	p.record(event)
+}
+
+// Drop a replica that is no longer running from a replicated app
+func (p *Publisher) RemoveReplica(key, replica string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.state[key].Replicas[replica]; !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	p.updateReplicas(key, &now, func(replicas map[string]Status) {
+		delete(replicas, replica)
+	})
+}
+
+// apply a change to a copy of the app's replicas, so previously published
+// events are left untouched, then re-aggregate. caller must hold the lock
+func (p *Publisher) updateReplicas(key string, at *time.Time, update func(map[string]Status)) {
+	event := Event{Name: key}
+	old, ok := p.state[key]
+	if ok {
+		event.Old = &old
+	}
+
+	status := old
+	status.Replicas = make(map[string]Status, len(old.Replicas)+1)
+	for name, replica := range old.Replicas {
+		status.Replicas[name] = replica
+	}
+	update(status.Replicas)
+	when := time.Now().UTC()
+	if at != nil {
+		when = *at
+	}
+	status.aggregate(when)
+	status.At = at
+
+	p.state[key] = status
+	event.New = status
+	p.record(event)
+}
+
+// Unregister an app that is no longer monitored
+func (p *Publisher) Remove(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	old, ok := p.state[key]
+	if !ok {
+		return
+	}
+	delete(p.state, key)
+
+	p.record(Event{Name: key, Old: &old, Removed: true})
+}
+
+// sequence and retain an event, and wake any waiters. caller must hold the lock
+func (p *Publisher) record(event Event) {
+	p.seq++
+	event.ID = p.seq
+	event.At = time.Now().UTC()
+
+	p.history = append(p.history, event)
+	if len(p.history) > maxEventHistory {
+		p.history = p.history[len(p.history)-maxEventHistory:]
+	}
+
+	p.wake()
+}
+
+// wake any waiters, as statuses may have changed. caller must hold the lock
+func (p *Publisher) wake() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Replace the dependency graph. A target is only reported ready once it and
+// all of its transitive dependencies are, and is reported failed if any of
+// its dependencies fails
+func (p *Publisher) SetDependencies(deps map[string][]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.deps = map[string][]string{}
+	for name, upstream := range deps {
+		sorted := append([]string(nil), upstream...)
+		sort.Strings(sorted)
+		p.deps[name] = sorted
+	}
+
+	p.wake()
+}
+
+// Replace the named groups of apps; members may be apps or other groups
+func (p *Publisher) SetGroups(groups map[string][]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.groups = map[string][]string{}
+	for name, members := range groups {
+		p.groups[name] = append([]string(nil), members...)
+	}
+}
+
+// Resolve the named groups to the apps they contain, including those of
+// nested groups. Errors if any group is not defined
+func (p *Publisher) ExpandGroups(groups []string) ([]string, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	out, err := config.ExpandGroups(p.groups, groups)
+	if err != nil {
+		p.logger.Printf("ERROR %s", err)
+	}
+	return out, err
+}
+
+// Obtain the serialized members of every group, with nested groups expanded
+func (p *Publisher) GetGroups() ([]byte, int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	out := make(map[string][]string, len(p.groups))
+	for name := range p.groups {
+		members, err := config.ExpandGroups(p.groups, []string{name})
+		if err != nil {
+			p.logger.Printf("ERROR %s", err)
+			return []byte(err.Error()), http.StatusInternalServerError
+		}
+		out[name] = members
+	}
+
+	buf, err := json.Marshal(out)
+	if err != nil {
+		p.logger.Printf("ERROR failed to marshal groups: %s", err)
+		return []byte("failed to serialize groups"), http.StatusInternalServerError
+	}
+
+	return buf, http.StatusOK
+}
+
+// the status of a registered app as reported by the API, accounting for its
+// dependencies. caller must hold the lock
+func (p *Publisher) resolve(name string) Status {
+	status := p.state[name]
+	if len(p.deps[name]) == 0 {
+		return status
+	}
+
+	if dep, code := p.upstreamFailure(name, map[string]bool{}); len(dep) > 0 && status.code() != http.StatusServiceUnavailable {
+		status.Ready = false
+		if code == http.StatusServiceUnavailable {
+			status.Phase = PhaseFailed
+			status.Error = fmt.Sprintf("dependency %s failed", dep)
+		} else if status.code() != http.StatusGatewayTimeout {
+			status.Phase = PhaseTimedOut
+			status.Error = fmt.Sprintf("dependency %s timed out", dep)
+		}
+	}
+
+	status.BlockedBy = p.blockingPath(name)
+	if len(status.BlockedBy) > 0 && status.code() == http.StatusOK {
+		status.Ready = false
+		status.Phase = PhaseBlocked
+	}
+
+	return status
+}
+
+// the first transitive dependency found to have failed or, failing that, to
+// have timed out, and its status code. caller must hold the lock
+func (p *Publisher) upstreamFailure(name string, seen map[string]bool) (string, int) {
+	timedOut := ""
+	for _, dep := range p.deps[name] {
+		if seen[dep] {
+			continue
+		}
+		seen[dep] = true
+
+		code := p.ownCode(dep)
+		if code == http.StatusServiceUnavailable {
+			return dep, code
+		}
+		if code == http.StatusGatewayTimeout && len(timedOut) == 0 {
+			timedOut = dep
+		}
+
+		upstream, upstreamCode := p.upstreamFailure(dep, seen)
+		if upstreamCode == http.StatusServiceUnavailable {
+			return upstream, upstreamCode
+		}
+		if upstreamCode == http.StatusGatewayTimeout && len(timedOut) == 0 {
+			timedOut = upstream
+		}
+	}
+
+	if len(timedOut) > 0 {
+		return timedOut, http.StatusGatewayTimeout
+	}
+	return "", 0
+}
+
+// the path from a target through the first of its dependencies that isn't
+// ready, down to one that isn't ready itself. caller must hold the lock
+func (p *Publisher) blockingPath(name string) []string {
+	for _, dep := range p.deps[name] {
+		below := p.blockingPath(dep)
+		if len(below) > 0 || p.ownCode(dep) != http.StatusOK {
+			return append([]string{dep}, below...)
+		}
+	}
+	return nil
+}
+
+// an app's status code ignoring its dependencies; unregistered apps aren't
+// ready. caller must hold the lock
+func (p *Publisher) ownCode(name string) int {
+	status, ok := p.state[name]
+	if !ok {
+		return http.StatusAccepted
+	}
+	return status.code()
+}
+
+// Obtain the serialized dependency graph for a selection of registered
+// services, or for all of them if none are specified
+func (p *Publisher) GetGraph(services []string) ([]byte, int) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if len(services) == 0 {
+		for name := range p.state {
+			services = append(services, name)
+		}
+	}
+
+	out := map[string]GraphNode{}
+	for _, name := range services {
+		if _, ok := p.state[name]; !ok {
+			msg := fmt.Sprintf("requested service (%s) is not registered", name)
+			p.logger.Printf("ERROR %s", msg)
+			return []byte(msg), http.StatusNotFound
+		}
+
+		status := p.resolve(name)
+		out[name] = GraphNode{
+			DependsOn: append([]string{}, p.deps[name]...),
+			Ready:     status.Ready,
+			Phase:     status.Phase,
+			BlockedBy: status.BlockedBy,
+		}
+	}
+
+	buf, err := json.Marshal(out)
+	if err != nil {
+		p.logger.Printf("ERROR failed to marshal dependency graph: %s", err)
+		return []byte("failed to serialize dependency graph"), http.StatusInternalServerError
+	}
+
+	return buf, http.StatusOK
+}
+
+// Obtain a channel that will be closed at the next status update
+func (p *Publisher) Changed() <-chan struct{} {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.changed
+}
+
+// The ID of the most recently published event
+func (p *Publisher) Sequence() uint64 {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.seq
+}
+
+// Find where an event stream resuming after the given event ID should pick up.
+// An ID ahead of the sequence predates a restart of whalewatcher, so the stream
+// starts over from the first event. If events after the ID have aged out of the
+// history, the current statuses are returned to stand in for them, along with
+// the ID of the latest event they reflect
+func (p *Publisher) Resume(after uint64) (uint64, map[string]Status) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if after > p.seq {
+		after = 0
+	}
+	if len(p.history) > 0 && p.history[0].ID > after+1 {
+		return p.seq, p.resolveAll()
+	}
+
+	return after, nil
+}
+
+// Obtain the retained events published after the given event ID, and a
+// channel that will be closed when the next event is published. If events
+// after the ID have aged out of the history, the oldest retained are returned
+func (p *Publisher) EventsSince(after uint64) ([]Event, <-chan struct{}) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	// history is ordered by ID, so find the first event newer than after
+	start := len(p.history)
+	for start > 0 && p.history[start-1].ID > after {
+		start--
+	}
+
+	out := make([]Event, len(p.history)-start)
+	copy(out, p.history[start:])
+
+	return out, p.changed
+}
+
+// Block until the requested services (or all registered apps, if none are
+// specified) are all ready, any has failed or timed out, or ctx is done.
+// The response is the same as GetStatuses or GetAll at that moment
+func (p *Publisher) Wait(ctx context.Context, services []string) ([]byte, int) {
+	for {
+		// grab the channel before reading status so no update can slip between them
+		changed := p.Changed()
+
+		var buf []byte
+		var status int
+		if len(services) == 0 {
+			buf, status = p.GetAll()
+		} else {
+			buf, status = p.GetStatuses(services)
+		}
+
+		if status != http.StatusAccepted {
+			return buf, status
+		}
+
+		select {
+		case <-ctx.Done():
+			return buf, status
+		case <-changed:
+		}
+	}
 }
 
 // Obtain serialized status update for a selection of registered services
@@ -63,19 +682,38 @@ func (p *Publisher) GetStatuses(services []string) ([]byte, int) {
 	return buf, determineStatus(out)
 }
 
+// Obtain a copy of the current status of all registered apps, as the API reports them
+func (p *Publisher) Snapshot() map[string]Status {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.resolveAll()
+}
+
+// caller must hold the lock
+func (p *Publisher) resolveAll() map[string]Status {
+	out := make(map[string]Status, len(p.state))
+	for name := range p.state {
+		out[name] = p.resolve(name)
+	}
+
+	return out
+}
+
 // Obtain serialized status update for all registered apps
 func (p *Publisher) GetAll() ([]byte, int) {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
 
 	// if the event payload won't marshal, respond 500
-	buf, err := json.Marshal(p.state)
+	out := p.resolveAll()
+	buf, err := json.Marshal(out)
 	if err != nil {
 		p.logger.Printf("ERROR failed to marshal status map: %s", err)
 		return []byte("failed to marshal status map"), http.StatusInternalServerError
 	}
 
-	return buf, determineStatus(p.state)
+	return buf, determineStatus(out)
 }
 
 // fetch status updates only for the registered services supplied by the caller
@@ -85,7 +723,7 @@ func (p *Publisher) populate(services []string) (map[string]Status, error) {
 
 	out := map[string]Status{}
 	for _, name := range services {
-		evt, ok := p.state[name]
+		_, ok := p.state[name]
 		if !ok {
 			// if there is no app by that name registered, error
 			msg := fmt.Sprintf("requested service (%s) is not registered", name)
@@ -93,7 +731,7 @@ func (p *Publisher) populate(services []string) (map[string]Status, error) {
 			return nil, errors.New(msg)
 		}
 
-		out[name] = evt
+		out[name] = p.resolve(name)
 	}
 
 	return out, nil
@@ -103,20 +741,20 @@ func (p *Publisher) populate(services []string) (map[string]Status, error) {
 // in aggregate based on the apps requested:
 //
 // - if any tailed service (in a user request) is not registered: 404
-// - if any service has experienced a tailing error: 503
+// - if any service has failed, exited, or is shutting down: 503
 // - if the status update list fails to serialize: 500
+// - if any tailed service timed out without becoming ready: 504
 // - if any tailed service is not ready yet: 202
 // - if all tailed services are error free and ready: 200
+//
+// replicated services are ready once their quorum of replicas is ready, and
+// failed or timed out once too few replicas remain to reach it
 func determineStatus(out map[string]Status) int {
 	status := http.StatusOK
 
 	for _, evt := range out {
-		if len(evt.Error) > 0 {
-			status = http.StatusServiceUnavailable
-			break
-		}
-		if !evt.Ready {
-			status = http.StatusAccepted
+		if code := evt.code(); statusRank[code] > statusRank[status] {
+			status = code
 		}
 	}
 
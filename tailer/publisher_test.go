@@ -1,10 +1,15 @@
 package tailer
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"testing"
 	"time"
 
+	"github.com/elireisman/whalewatcher/config"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -86,3 +91,422 @@ func TestPublishWithFilteredStatusCheckAndError(t *testing.T) {
 	require.Equal(t, 200, status)
 	require.Equal(t, expected, got)
 }
+
+func TestPublishTimedOut(t *testing.T) {
+	pub := NewPublisher()
+	now := time.Now().UTC()
+
+	out := fmt.Sprintf(`{"foo":{"ready":true,"at":%q,"error":"","timed_out":true}}`, now.Format(time.RFC3339Nano))
+	expected := []byte(out)
+
+	// readiness inferred from timeout is still ready
+	pub.Add("foo", Status{Ready: true, At: &now, TimedOut: true})
+	got, status := pub.GetAll()
+	require.Equal(t, 200, status)
+	require.Equal(t, expected, got)
+
+	// a target timed out without becoming ready outranks one still warming up
+	pub.Add("bar", Status{})
+	pub.Add("baz", Status{At: &now, TimedOut: true})
+	_, status = pub.GetAll()
+	require.Equal(t, 504, status)
+
+	_, status = pub.GetStatuses([]string{"foo", "bar"})
+	require.Equal(t, 202, status)
+}
+
+func TestPublishPhaseDeterminesStatus(t *testing.T) {
+	pub := NewPublisher()
+
+	pub.Add("foo", Status{Phase: PhaseReady, Ready: true})
+	pub.Add("bar", Status{Phase: PhaseStreaming})
+	_, status := pub.GetAll()
+	require.Equal(t, 202, status)
+
+	pub.Add("bar", Status{Phase: PhaseTimedOut, TimedOut: true})
+	_, status = pub.GetAll()
+	require.Equal(t, 504, status)
+
+	pub.Add("baz", Status{Phase: PhaseContainerExited})
+	_, status = pub.GetAll()
+	require.Equal(t, 503, status)
+
+	_, status = pub.GetStatuses([]string{"foo"})
+	require.Equal(t, 200, status)
+}
+
+func TestWaitReturnsWhenReady(t *testing.T) {
+	pub := NewPublisher()
+	pub.Add("foo", Status{})
+	pub.Add("bar", Status{})
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pub.Add("foo", Status{Ready: true})
+		time.Sleep(20 * time.Millisecond)
+		pub.Add("bar", Status{Ready: true})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+
+	_, status := pub.Wait(ctx, []string{"foo", "bar"})
+	require.Equal(t, 200, status)
+	require.NoError(t, ctx.Err())
+}
+
+func TestWaitReturnsOnFailure(t *testing.T) {
+	pub := NewPublisher()
+	pub.Add("foo", Status{})
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pub.Add("foo", Status{Error: "ouch"})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+
+	_, status := pub.Wait(ctx, nil)
+	require.Equal(t, 503, status)
+}
+
+func TestWaitTimesOut(t *testing.T) {
+	pub := NewPublisher()
+	pub.Add("foo", Status{})
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Millisecond)
+	defer cancel()
+
+	_, status := pub.Wait(ctx, []string{"foo"})
+	require.Equal(t, 202, status)
+	require.Error(t, ctx.Err())
+}
+
+func TestWaitMissingTarget(t *testing.T) {
+	pub := NewPublisher()
+	pub.Add("foo", Status{})
+
+	_, status := pub.Wait(context.TODO(), []string{"bar"})
+	require.Equal(t, 404, status)
+}
+
+func TestEventsSince(t *testing.T) {
+	pub := NewPublisher()
+	require.Equal(t, uint64(0), pub.Sequence())
+
+	pub.Add("foo", Status{})
+	pub.Add("bar", Status{})
+	pub.Add("foo", Status{Ready: true})
+	require.Equal(t, uint64(3), pub.Sequence())
+
+	events, changed := pub.EventsSince(0)
+	require.Len(t, events, 3)
+	require.Nil(t, events[0].Old)
+	require.Equal(t, "foo", events[2].Name)
+	require.False(t, events[2].Old.Ready)
+	require.True(t, events[2].New.Ready)
+
+	// resume after the first event
+	events, _ = pub.EventsSince(1)
+	require.Len(t, events, 2)
+	require.Equal(t, uint64(2), events[0].ID)
+
+	events, _ = pub.EventsSince(3)
+	require.Empty(t, events)
+
+	pub.Add("bar", Status{Error: "ouch"})
+	select {
+	case <-changed:
+	default:
+		require.FailNow(t, "expected change notification")
+	}
+}
+
+func TestEventsResume(t *testing.T) {
+	pub := NewPublisher()
+	for i := 0; i < maxEventHistory+10; i++ {
+		pub.Add("foo", Status{})
+	}
+	pub.Add("bar", Status{Ready: true})
+
+	// the events after 20 are still retained
+	last, snapshot := pub.Resume(20)
+	require.Equal(t, uint64(20), last)
+	require.Nil(t, snapshot)
+
+	// those after 5 have aged out, so the current statuses stand in for them
+	last, snapshot = pub.Resume(5)
+	require.Equal(t, pub.Sequence(), last)
+	require.Len(t, snapshot, 2)
+	require.True(t, snapshot["bar"].Ready)
+
+	// an ID from before a restart starts over from the beginning
+	pub = NewPublisher()
+	pub.Add("foo", Status{})
+	last, snapshot = pub.Resume(500)
+	require.Equal(t, uint64(0), last)
+	require.Nil(t, snapshot)
+}
+
+func TestEventHistoryIsBounded(t *testing.T) {
+	pub := NewPublisher()
+	for i := 0; i < maxEventHistory+10; i++ {
+		pub.Add("foo", Status{})
+	}
+
+	events, _ := pub.EventsSince(0)
+	require.Len(t, events, maxEventHistory)
+	require.Equal(t, uint64(11), events[0].ID)
+	require.Equal(t, uint64(maxEventHistory+10), events[len(events)-1].ID)
+}
+
+func TestRemove(t *testing.T) {
+	pub := NewPublisher()
+	pub.Add("foo", Status{Ready: true})
+	pub.Add("bar", Status{})
+
+	pub.Remove("bar")
+	pub.Remove("does_not_exist")
+
+	_, status := pub.GetAll()
+	require.Equal(t, 200, status)
+	_, status = pub.GetStatuses([]string{"bar"})
+	require.Equal(t, 404, status)
+
+	events, _ := pub.EventsSince(2)
+	require.Len(t, events, 1)
+	require.True(t, events[0].Removed)
+	require.Equal(t, "bar", events[0].Name)
+}
+
+func TestReplicaQuorum(t *testing.T) {
+	replicas := func(phases ...Phase) map[string]Status {
+		out := map[string]Status{}
+		for i, phase := range phases {
+			out[fmt.Sprintf("r%d", i)] = Status{Phase: phase}
+		}
+		return out
+	}
+
+	for _, tc := range []struct {
+		status Status
+		code   int
+	}{
+		{Status{Replicas: replicas(PhaseReady, PhaseReady)}, http.StatusOK},
+		{Status{Replicas: replicas(PhaseReady, PhaseStreaming)}, http.StatusAccepted},
+		{Status{Replicas: replicas(PhaseReady, PhaseFailed)}, http.StatusServiceUnavailable},
+		{Status{Replicas: replicas(PhaseReady, PhaseTimedOut)}, http.StatusGatewayTimeout},
+		{Status{Quorum: config.QuorumAny, Replicas: replicas(PhaseReady, PhaseFailed)}, http.StatusOK},
+		{Status{Quorum: config.QuorumAny, Replicas: replicas(PhaseStreaming, PhaseFailed)}, http.StatusAccepted},
+		{Status{Quorum: config.QuorumAny, Replicas: replicas(PhaseFailed, PhaseTimedOut)}, http.StatusServiceUnavailable},
+		{Status{MinReady: 2, Replicas: replicas(PhaseReady, PhaseStreaming, PhaseFailed)}, http.StatusAccepted},
+		{Status{MinReady: 2, Replicas: replicas(PhaseReady, PhaseReady, PhaseFailed)}, http.StatusOK},
+		{Status{MinReady: 2, Replicas: replicas(PhaseReady, PhaseFailed, PhaseFailed)}, http.StatusServiceUnavailable},
+		{Status{MinReady: 3, Replicas: replicas(PhaseReady, PhaseReady)}, http.StatusAccepted},
+		// exited replicas aren't required by an "all" quorum, but can't count toward others
+		{Status{Replicas: replicas(PhaseReady, PhaseContainerExited)}, http.StatusOK},
+		{Status{Replicas: replicas(PhaseStreaming, PhaseContainerExited)}, http.StatusAccepted},
+		{Status{Replicas: replicas(PhaseContainerExited, PhaseContainerExited)}, http.StatusServiceUnavailable},
+		{Status{Quorum: config.QuorumAny, Replicas: replicas(PhaseContainerExited, PhaseContainerExited)}, http.StatusServiceUnavailable},
+		{Status{MinReady: 2, Replicas: replicas(PhaseReady, PhaseContainerExited, PhaseContainerExited)}, http.StatusServiceUnavailable},
+	} {
+		require.Equal(t, tc.code, determineStatus(map[string]Status{"foo": tc.status}), "%+v", tc.status)
+	}
+}
+
+func TestAddAndRemoveReplicas(t *testing.T) {
+	pub := NewPublisher()
+	pub.Add("foo", Status{Phase: PhaseAwaitingContainer, Quorum: config.QuorumAny})
+
+	pub.AddReplica("foo", "foo_1", Status{Phase: PhaseStreaming})
+	pub.AddReplica("foo", "foo_2", Status{Phase: PhaseReady, Ready: true})
+	status := pub.Snapshot()["foo"]
+	require.True(t, status.Ready)
+	require.Equal(t, PhaseReady, status.Phase)
+	require.Equal(t, config.QuorumAny, status.Quorum)
+	require.Len(t, status.Replicas, 2)
+
+	pub.RemoveReplica("foo", "foo_2")
+	pub.RemoveReplica("foo", "missing")
+	status = pub.Snapshot()["foo"]
+	require.False(t, status.Ready)
+	require.Equal(t, PhaseStreaming, status.Phase)
+
+	pub.RemoveReplica("foo", "foo_1")
+	status = pub.Snapshot()["foo"]
+	require.Equal(t, PhaseAwaitingContainer, status.Phase)
+	require.Nil(t, status.Replicas)
+
+	// published events keep the replicas as they were at the time
+	events, _ := pub.EventsSince(0)
+	require.Len(t, events, 5)
+	require.Len(t, events[2].New.Replicas, 2)
+	require.Len(t, events[3].New.Replicas, 1)
+}
+
+func TestReplicaPhaseEntryTimes(t *testing.T) {
+	pub := NewPublisher()
+	registered := time.Now().UTC()
+	pub.Add("foo", Status{Phase: PhaseAwaitingContainer, Entered: map[Phase]time.Time{
+		PhaseRegistered:        registered,
+		PhaseAwaitingContainer: registered,
+	}})
+
+	streaming := registered.Add(time.Second)
+	pub.AddReplica("foo", "foo-1", Status{Phase: PhaseStreaming, At: &streaming})
+	pub.AddReplica("foo", "foo-2", Status{Phase: PhaseStreaming, At: &streaming})
+
+	// another replica update in the same phase doesn't move its entry time
+	later := streaming.Add(time.Second)
+	pub.AddReplica("foo", "foo-1", Status{Phase: PhaseReady, Ready: true, At: &later})
+
+	ready := later.Add(time.Second)
+	pub.AddReplica("foo", "foo-2", Status{Phase: PhaseReady, Ready: true, At: &ready})
+
+	status := pub.Snapshot()["foo"]
+	require.Equal(t, PhaseReady, status.Phase)
+	require.Equal(t, map[Phase]time.Time{
+		PhaseRegistered:        registered,
+		PhaseAwaitingContainer: registered,
+		PhaseStreaming:         streaming,
+		PhaseReady:             ready,
+	}, status.Entered)
+
+	// a replica exiting, say while scaling down, leaves the rest ready
+	exited := ready.Add(time.Second)
+	pub.AddReplica("foo", "foo-2", Status{Phase: PhaseContainerExited, At: &exited})
+	status = pub.Snapshot()["foo"]
+	require.True(t, status.Ready)
+	require.Equal(t, ready, status.Entered[PhaseReady])
+
+	// published events keep the entry times as they were at the time
+	events, _ := pub.EventsSince(0)
+	require.NotContains(t, events[1].New.Entered, PhaseReady)
+}
+
+func TestDependenciesBlockReadiness(t *testing.T) {
+	pub := NewPublisher()
+	pub.SetDependencies(map[string][]string{
+		"app":   {"kafka"},
+		"kafka": {"zk"},
+	})
+	pub.Add("zk", Status{Phase: PhaseStreaming})
+	pub.Add("kafka", Status{Ready: true, Phase: PhaseReady})
+	pub.Add("app", Status{Ready: true, Phase: PhaseReady})
+
+	app := pub.Snapshot()["app"]
+	require.False(t, app.Ready)
+	require.Equal(t, PhaseBlocked, app.Phase)
+	require.Equal(t, []string{"kafka", "zk"}, app.BlockedBy)
+	require.Equal(t, []string{"zk"}, pub.Snapshot()["kafka"].BlockedBy)
+
+	_, status := pub.GetStatuses([]string{"app"})
+	require.Equal(t, http.StatusAccepted, status)
+
+	// raw statuses are still published as events
+	events, _ := pub.EventsSince(0)
+	require.Equal(t, PhaseReady, events[len(events)-1].New.Phase)
+
+	pub.Add("zk", Status{Ready: true, Phase: PhaseReady})
+	app = pub.Snapshot()["app"]
+	require.True(t, app.Ready)
+	require.Empty(t, app.BlockedBy)
+
+	_, status = pub.GetStatuses([]string{"app"})
+	require.Equal(t, http.StatusOK, status)
+}
+
+func TestDependencyFailurePropagates(t *testing.T) {
+	pub := NewPublisher()
+	pub.SetDependencies(map[string][]string{
+		"app":   {"kafka"},
+		"kafka": {"zk"},
+	})
+	pub.Add("zk", Status{Phase: PhaseFailed, Error: "boom"})
+	pub.Add("kafka", Status{Phase: PhaseStreaming})
+	pub.Add("app", Status{Phase: PhaseStreaming})
+
+	app := pub.Snapshot()["app"]
+	require.Equal(t, PhaseFailed, app.Phase)
+	require.Equal(t, "dependency zk failed", app.Error)
+
+	_, status := pub.GetAll()
+	require.Equal(t, http.StatusServiceUnavailable, status)
+
+	pub.Add("zk", Status{Phase: PhaseTimedOut, TimedOut: true})
+	app = pub.Snapshot()["app"]
+	require.Equal(t, PhaseTimedOut, app.Phase)
+	require.Equal(t, "dependency zk timed out", app.Error)
+
+	// a target's own failure takes precedence
+	pub.Add("app", Status{Phase: PhaseFailed, Error: "own"})
+	require.Equal(t, "own", pub.Snapshot()["app"].Error)
+}
+
+func TestWaitWakesOnDependencyChange(t *testing.T) {
+	pub := NewPublisher()
+	pub.Add("zk", Status{Phase: PhaseStreaming})
+	pub.Add("app", Status{Ready: true, Phase: PhaseReady})
+
+	// no dependency yet, so app is ready
+	_, status := pub.GetStatuses([]string{"app"})
+	require.Equal(t, http.StatusOK, status)
+
+	pub.SetDependencies(map[string][]string{"app": {"zk"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, status = pub.Wait(ctx, []string{"app"})
+	require.Equal(t, http.StatusAccepted, status)
+}
+
+func TestGetGraph(t *testing.T) {
+	pub := NewPublisher()
+	pub.SetDependencies(map[string][]string{"app": {"zk", "kafka"}})
+	pub.Add("zk", Status{Ready: true, Phase: PhaseReady})
+	pub.Add("kafka", Status{Phase: PhaseStreaming})
+	pub.Add("app", Status{Ready: true, Phase: PhaseReady})
+
+	buf, status := pub.GetGraph([]string{"app"})
+	require.Equal(t, http.StatusOK, status)
+
+	graph := map[string]GraphNode{}
+	require.NoError(t, json.Unmarshal(buf, &graph))
+	require.Equal(t, GraphNode{
+		DependsOn: []string{"kafka", "zk"},
+		Phase:     PhaseBlocked,
+		BlockedBy: []string{"kafka"},
+	}, graph["app"])
+
+	buf, status = pub.GetGraph(nil)
+	require.Equal(t, http.StatusOK, status)
+	graph = map[string]GraphNode{}
+	require.NoError(t, json.Unmarshal(buf, &graph))
+	require.Len(t, graph, 3)
+	require.Empty(t, graph["zk"].DependsOn)
+
+	_, status = pub.GetGraph([]string{"nope"})
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestGroups(t *testing.T) {
+	pub := NewPublisher()
+	pub.SetGroups(map[string][]string{
+		"streaming": {"zk", "kafka"},
+		"backend":   {"streaming", "mysql"},
+	})
+
+	members, err := pub.ExpandGroups([]string{"backend"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"kafka", "mysql", "zk"}, members)
+
+	_, err = pub.ExpandGroups([]string{"frontend"})
+	require.Error(t, err)
+
+	buf, status := pub.GetGroups()
+	require.Equal(t, http.StatusOK, status)
+	groups := map[string][]string{}
+	require.NoError(t, json.Unmarshal(buf, &groups))
+	require.Equal(t, []string{"kafka", "zk"}, groups["streaming"])
+	require.Len(t, groups["backend"], 3)
+}
@@ -0,0 +1,191 @@
+package tailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/elireisman/whalewatcher/config"
+
+	docker "github.com/docker/docker/client"
+)
+
+// monitors every container selected by a replicated target, each replica with
+// its own Tailer, publishing all of their statuses under the one target
+type ReplicaSet struct {
+	Ctx          context.Context
+	Name         string
+	Target       config.Container
+	AwaitStartup time.Duration
+
+	Publisher *Publisher
+	Discovery *Discovery
+	Client    docker.APIClient
+	Logger    *log.Logger
+
+	// replicas by container ID
+	replicas map[string]*replica
+	wg       *sync.WaitGroup
+
+	// the target's own phases, until replicas are found
+	lifecycle *lifecycle
+}
+
+// one replica's tailer, and the means to stop it
+type replica struct {
+	name   string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// obtain a ReplicaSet for the target, registering it with the Publisher
+func NewReplicaSet(ctx context.Context, client docker.APIClient, disco *Discovery, pub *Publisher, name string, target config.Container, awaitStartup time.Duration) (*ReplicaSet, error) {
+	if err := target.Validate(); err != nil {
+		return nil, err
+	}
+
+	rs := &ReplicaSet{
+		Ctx:          ctx,
+		Name:         name,
+		Target:       target,
+		AwaitStartup: awaitStartup,
+		Publisher:    pub,
+		Discovery:    disco,
+		Client:       client,
+		Logger:       log.New(os.Stdout, fmt.Sprintf("[monitoring: %s] ", name), log.LstdFlags),
+		replicas:     map[string]*replica{},
+		wg:           &sync.WaitGroup{},
+		lifecycle:    newLifecycle(),
+	}
+
+	rs.publish(PhaseRegistered, "")
+	rs.Logger.Println("INFO replicated target registered for monitoring")
+
+	return rs, nil
+}
+
+// caller should execute this in a goroutine; returns once ctx is canceled
+// and every replica's tailer has finished
+func (rs *ReplicaSet) Start() {
+	sub := rs.Discovery.Subscribe(func(info ContainerInfo) bool {
+		return selects(info, rs.Name, rs.Target.Service, rs.Target.Project, rs.Target.Match)
+	})
+	defer sub.Close()
+
+	rs.Logger.Printf("INFO awaiting replica startup for interval: %s", rs.AwaitStartup)
+	rs.publish(PhaseAwaitingContainer, "")
+	startup := time.After(rs.AwaitStartup)
+
+	for {
+		select {
+		case <-rs.Ctx.Done():
+			rs.shutdown()
+			return
+
+		case <-startup:
+			if len(rs.replicas) == 0 {
+				rs.publish(PhaseFailed, fmt.Sprintf("failed to find any replicas of %s in %s", rs.Name, rs.AwaitStartup))
+			}
+
+		case evt := <-sub.Events:
+			info := evt.Container
+			_, known := rs.replicas[info.ID]
+
+			switch {
+			case info.Running && !known:
+				rs.add(info)
+			case evt.Action == ActionDestroy && known:
+				rs.remove(info.ID)
+			}
+		}
+	}
+}
+
+// begin tailing a newly discovered replica
+func (rs *ReplicaSet) add(info ContainerInfo) {
+	ctx, cancel := context.WithCancel(rs.Ctx)
+	t, err := build(ctx, rs.Client, rs.Discovery, rs.Publisher, rs.Name, rs.Target, rs.AwaitStartup)
+	if err != nil {
+		cancel()
+		rs.Logger.Printf("ERROR failed to monitor replica %s: %s", info.Name, err)
+		return
+	}
+	t.ID = info.ID
+	t.Replica = info.Name
+	t.Logger = log.New(os.Stdout, fmt.Sprintf("[monitoring: %s/%s] ", rs.Name, info.Name), log.LstdFlags)
+
+	r := &replica{name: info.Name, cancel: cancel, done: make(chan struct{})}
+	rs.replicas[info.ID] = r
+	rs.Logger.Printf("INFO replica %s (%s) discovered, %d replicas known", info.Name, info.ID, len(rs.replicas))
+
+	t.register()
+	rs.wg.Add(1)
+	go func() {
+		defer rs.wg.Done()
+		defer close(r.done)
+		defer func() {
+			// a crashed replica fails alone, as the Manager does for a whole target
+			if r := recover(); r != nil {
+				msg := fmt.Sprintf("tailer panicked: %v", r)
+				t.Logger.Printf("ERROR replica %s", msg)
+				t.fail(msg)
+			}
+		}()
+
+		t.Start()
+	}()
+}
+
+// stop tailing a replica whose container was removed, and drop its status
+func (rs *ReplicaSet) remove(id string) {
+	r := rs.replicas[id]
+	r.cancel()
+	<-r.done
+
+	delete(rs.replicas, id)
+	rs.Publisher.RemoveReplica(rs.Name, r.name)
+	rs.Logger.Printf("INFO replica %s removed, %d replicas remain", r.name, len(rs.replicas))
+}
+
+// wait for the replicas' tailers to publish that they're shutting down
+func (rs *ReplicaSet) shutdown() {
+	rs.wg.Wait()
+	if len(rs.replicas) == 0 {
+		rs.publish(PhaseShuttingDown, "")
+	}
+	rs.Logger.Println("INFO replicated target shutting down (shutdown requested)")
+}
+
+// publish that the target failed outright, i.e. its monitor crashed
+func (rs *ReplicaSet) fail(msg string) {
+	// stop the replicas first, so none of their updates can replace the failure
+	for _, r := range rs.replicas {
+		r.cancel()
+	}
+	rs.wg.Wait()
+
+	now := time.Now().UTC()
+	rs.lifecycle.crash(now)
+	rs.Publisher.Fail(rs.Name, msg, now)
+}
+
+// publish a status for the target as a whole, before any replicas are found
+func (rs *ReplicaSet) publish(phase Phase, msg string) {
+	now := time.Now().UTC()
+	if err := rs.lifecycle.enter(phase, now); err != nil {
+		rs.Logger.Printf("ERROR %s", err)
+		return
+	}
+
+	rs.Publisher.Add(rs.Name, Status{
+		At:       &now,
+		Error:    msg,
+		Phase:    phase,
+		Entered:  rs.lifecycle.history(),
+		Quorum:   rs.Target.Quorum,
+		MinReady: rs.Target.MinReady,
+	})
+}
@@ -0,0 +1,211 @@
+package tailer
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elireisman/whalewatcher/config"
+
+	docker_types "github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/require"
+)
+
+func workerReplica(id string) ContainerInfo {
+	return ContainerInfo{
+		ID:      id,
+		Name:    "demo-worker-" + id,
+		Running: true,
+		Labels: map[string]string{
+			config.ComposeProjectLabel: "demo",
+			config.ComposeServiceLabel: "worker",
+		},
+	}
+}
+
+func requireCode(t *testing.T, pub *Publisher, name string, code int) {
+	require.Eventually(t, func() bool {
+		_, status := pub.GetStatuses([]string{name})
+		return status == code
+	}, time.Second, 5*time.Millisecond, "target %s never reached status %d", name, code)
+}
+
+func TestReplicaSetQuorum(t *testing.T) {
+	client := &fakeDocker{
+		containers: map[string]docker_types.ContainerJSON{
+			"1": runningContainer("1"),
+			"2": runningContainer("2"),
+			"3": runningContainer("3"),
+		},
+		logs: map[string]string{
+			"1": "booting\nready\n",
+			"2": "ready\n",
+			"3": "booting\n",
+		},
+	}
+	disco := NewDiscovery(nil)
+	pub := NewPublisher()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	target := config.Container{Pattern: "^ready$", Service: "worker", Project: "demo", MinReady: 2}
+	rs, err := NewReplicaSet(ctx, client, disco, pub, "worker", target, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, PhaseRegistered, pub.state["worker"].Phase)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rs.Start()
+	}()
+
+	// one ready replica falls short of the quorum
+	disco.started(workerReplica("1"))
+	disco.started(ContainerInfo{ID: "4", Name: "demo-other-4", Running: true})
+	requirePhase(t, pub, "worker", PhaseStreaming)
+	requireCode(t, pub, "worker", http.StatusAccepted)
+
+	disco.started(workerReplica("2"))
+	disco.started(workerReplica("3"))
+	requireCode(t, pub, "worker", http.StatusOK)
+
+	// the third replica's log closes while it runs, so it fails
+	require.Eventually(t, func() bool {
+		return pub.Snapshot()["worker"].Replicas["demo-worker-3"].Phase == PhaseFailed
+	}, time.Second, 5*time.Millisecond)
+	status := pub.Snapshot()["worker"]
+	require.True(t, status.Ready)
+	require.Equal(t, PhaseReady, status.Phase)
+	require.Len(t, status.Replicas, 3)
+	require.Equal(t, "1", status.Replicas["demo-worker-1"].ContainerID)
+	require.Equal(t, 2, status.MinReady)
+
+	// removing a ready replica leaves too few to reach the quorum
+	disco.stopped("1", ActionDestroy)
+	requireCode(t, pub, "worker", http.StatusServiceUnavailable)
+	status = pub.Snapshot()["worker"]
+	require.Equal(t, PhaseFailed, status.Phase)
+	require.Len(t, status.Replicas, 2)
+
+	cancel()
+	<-done
+}
+
+func TestReplicaSetWithoutReplicas(t *testing.T) {
+	pub := NewPublisher()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	target := config.Container{Pattern: "^ready$", Match: "demo-worker-*"}
+	rs, err := NewReplicaSet(ctx, &fakeDocker{}, NewDiscovery(nil), pub, "worker", target, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rs.Start()
+	}()
+
+	requirePhase(t, pub, "worker", PhaseFailed)
+	require.Contains(t, pub.Snapshot()["worker"].Error, "failed to find any replicas")
+
+	cancel()
+	<-done
+	require.Equal(t, PhaseShuttingDown, pub.Snapshot()["worker"].Phase)
+}
+
+func TestInvalidReplicaSet(t *testing.T) {
+	target := config.Container{Pattern: "^ready$", Service: "worker", Quorum: "most"}
+	_, err := NewReplicaSet(context.TODO(), nil, nil, NewPublisher(), "worker", target, time.Second)
+	require.Error(t, err)
+}
+
+func TestReplicaSetSurvivesReplicaPanics(t *testing.T) {
+	client := &fakeDocker{
+		containers: map[string]docker_types.ContainerJSON{
+			"1": runningContainer("1"),
+			"2": runningContainer("2"),
+		},
+		logs:   map[string]string{"1": "ready\n"},
+		follow: true,
+		crash:  map[string]bool{"2": true},
+	}
+	disco := NewDiscovery(nil)
+	pub := NewPublisher()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	target := config.Container{Pattern: "^ready$", Service: "worker", Project: "demo", Quorum: config.QuorumAny}
+	rs, err := NewReplicaSet(ctx, client, disco, pub, "worker", target, time.Minute)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rs.Start()
+	}()
+
+	// the crashed replica fails on its own, and the other keeps the quorum
+	disco.started(workerReplica("1"))
+	disco.started(workerReplica("2"))
+	require.Eventually(t, func() bool {
+		return pub.Snapshot()["worker"].Replicas["demo-worker-2"].Phase == PhaseFailed
+	}, time.Second, 5*time.Millisecond)
+	requireCode(t, pub, "worker", http.StatusOK)
+	require.Equal(t, "tailer panicked: log stream for 2 crashed", pub.Snapshot()["worker"].Replicas["demo-worker-2"].Error)
+
+	cancel()
+	<-done
+}
+
+// a replica set that crashes once its replica is ready
+type panickingReplicaSet struct {
+	*ReplicaSet
+}
+
+func (rs panickingReplicaSet) Start() {
+	rs.add(workerReplica("1"))
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if rs.Publisher.Snapshot()["worker"].Ready {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	panic("boom")
+}
+
+func TestReplicaSetPanicStopsReplicas(t *testing.T) {
+	client := &fakeDocker{
+		containers: map[string]docker_types.ContainerJSON{"1": runningContainer("1")},
+		logs:       map[string]string{"1": "ready\n"},
+		follow:     true,
+	}
+	pub := NewPublisher()
+	mgr := newTestManager(NewDiscovery(nil), pub)
+	defer mgr.Shutdown()
+
+	target := config.Container{Pattern: "^ready$", Service: "worker", Project: "demo", Mode: config.ModeContinuous}
+	rs, err := NewReplicaSet(mgr.ctx, client, mgr.disco, pub, "worker", target, time.Minute)
+	require.NoError(t, err)
+
+	mgr.disco.started(workerReplica("1"))
+
+	mt := &managedTarget{conf: target, cancel: func() {}, startedAt: time.Now().UTC(), done: make(chan struct{})}
+	mgr.lock.Lock()
+	mgr.targets["worker"] = mt
+	mgr.lock.Unlock()
+	mgr.run("worker", panickingReplicaSet{rs}, mt)
+
+	// the replicas are drained before the failure is published, and it keeps them
+	select {
+	case <-rs.replicas["1"].done:
+	default:
+		t.Fatal("replica still running after its replica set crashed")
+	}
+	status := pub.Snapshot()["worker"]
+	require.Equal(t, PhaseFailed, status.Phase)
+	require.False(t, status.Ready)
+	require.Equal(t, "tailer panicked: boom", status.Error)
+	require.Len(t, status.Replicas, 1)
+	require.Contains(t, status.Entered, PhaseReady)
+	require.Contains(t, status.Entered, PhaseFailed)
+	requireCode(t, pub, "worker", http.StatusServiceUnavailable)
+}
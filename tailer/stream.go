@@ -0,0 +1,185 @@
+package tailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// for containers without a TTY, Docker multiplexes stdout and stderr onto
+// a single log stream. each frame is prefixed with an 8 byte header:
+// [stream type, 0, 0, 0, payload size (big endian uint32)]
+const (
+	frameHeaderLen = 8
+
+	streamStdin  = 0
+	streamStdout = 1
+	streamStderr = 2
+	streamSysErr = 3
+
+	// lines longer than this are truncated, the remainder is discarded
+	maxLineBytes = 64 * 1024
+)
+
+// signals the line consumer has gone away and the stream should be abandoned
+var errStreamStopped = errors.New("log stream consumer stopped")
+
+// a single line read from a target container's log stream
+type Line struct {
+	Text string
+	Err  error
+}
+
+// reads a container log stream in the background, sending each line on the
+// returned channel. the channel is closed when the stream ends or ctx is done.
+// read errors are sent as a final Line unless ctx was canceled first
+func streamLines(ctx context.Context, r io.Reader, tty bool) <-chan Line {
+	out := make(chan Line)
+
+	go func() {
+		defer close(out)
+
+		emit := func(text string) error {
+			select {
+			case out <- Line{Text: text}:
+				return nil
+			case <-ctx.Done():
+				return errStreamStopped
+			}
+		}
+
+		var err error
+		if tty {
+			err = splitLines(r, emit)
+		} else {
+			err = demuxLines(r, emit)
+		}
+
+		if err != nil && err != errStreamStopped && ctx.Err() == nil {
+			select {
+			case out <- Line{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return out
+}
+
+// splits a raw (TTY) log stream into lines
+func splitLines(r io.Reader, emit func(string) error) error {
+	splitter := &lineSplitter{emit: emit}
+
+	if _, err := io.Copy(splitter, r); err != nil {
+		return err
+	}
+
+	return splitter.Close()
+}
+
+// demultiplexes a non-TTY log stream, splitting stdout and stderr into lines
+// independently so interleaved frames can't splice partial lines together
+func demuxLines(r io.Reader, emit func(string) error) error {
+	stdout := &lineSplitter{emit: emit}
+	stderr := &lineSplitter{emit: emit}
+	header := make([]byte, frameHeaderLen)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				if err := stdout.Close(); err != nil {
+					return err
+				}
+				return stderr.Close()
+			}
+			return err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+
+		var dest io.Writer
+		switch header[0] {
+		case streamStdin, streamStdout:
+			dest = stdout
+		case streamStderr:
+			dest = stderr
+		case streamSysErr:
+			msg := &strings.Builder{}
+			if _, err := io.CopyN(msg, r, size); err != nil {
+				return err
+			}
+			return fmt.Errorf("error from daemon in log stream: %s", msg)
+		default:
+			return fmt.Errorf("unrecognized stream type %d in log frame header", header[0])
+		}
+
+		// io.CopyN uses a fixed size buffer, so large frames aren't read into memory whole
+		if _, err := io.CopyN(dest, r, size); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
+
+// buffers partial lines written to it, emitting each complete line
+type lineSplitter struct {
+	emit    func(string) error
+	buf     []byte
+	discard bool
+}
+
+func (ls *lineSplitter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		chunk := p
+		if end >= 0 {
+			chunk, p = p[:end], p[end+1:]
+		} else {
+			p = nil
+		}
+
+		if !ls.discard {
+			if room := maxLineBytes - len(ls.buf); len(chunk) > room {
+				ls.buf = append(ls.buf, chunk[:room]...)
+				if err := ls.flush(); err != nil {
+					return 0, err
+				}
+				ls.discard = true
+			} else {
+				ls.buf = append(ls.buf, chunk...)
+			}
+		}
+
+		if end >= 0 {
+			if ls.discard {
+				ls.discard = false
+			} else if err := ls.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// emit any trailing unterminated line
+func (ls *lineSplitter) Close() error {
+	if len(ls.buf) == 0 || ls.discard {
+		return nil
+	}
+	return ls.flush()
+}
+
+func (ls *lineSplitter) flush() error {
+	text := strings.TrimSuffix(string(ls.buf), "\r")
+	ls.buf = ls.buf[:0]
+	return ls.emit(text)
+}
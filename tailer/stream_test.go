@@ -0,0 +1,89 @@
+package tailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func frame(streamType byte, payload string) []byte {
+	header := make([]byte, frameHeaderLen)
+	header[0] = streamType
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func collect(t *testing.T, r io.Reader, tty bool) []Line {
+	out := []Line{}
+	for line := range streamLines(context.TODO(), r, tty) {
+		out = append(out, line)
+	}
+	return out
+}
+
+func TestDemuxStripsFrameHeaders(t *testing.T) {
+	stream := &bytes.Buffer{}
+	stream.Write(frame(streamStdout, "first line\nsecond "))
+	stream.Write(frame(streamStderr, "an error\n"))
+	stream.Write(frame(streamStdout, "line\r\nunterminated"))
+
+	lines := collect(t, stream, false)
+	require.Equal(t, []Line{
+		{Text: "first line"},
+		{Text: "an error"},
+		{Text: "second line"},
+		{Text: "unterminated"},
+	}, lines)
+}
+
+func TestDemuxTruncatedFrame(t *testing.T) {
+	raw := frame(streamStdout, "ready to go\n")
+	stream := bytes.NewReader(raw[:len(raw)-3])
+
+	lines := collect(t, stream, false)
+	require.Len(t, lines, 1)
+	require.Equal(t, io.ErrUnexpectedEOF, lines[0].Err)
+}
+
+func TestDemuxSystemError(t *testing.T) {
+	stream := bytes.NewReader(frame(streamSysErr, "boom"))
+
+	lines := collect(t, stream, false)
+	require.Len(t, lines, 1)
+	require.Contains(t, lines[0].Err.Error(), "boom")
+}
+
+func TestTTYStreamIsNotDemuxed(t *testing.T) {
+	stream := strings.NewReader("^anchored line\nanother\n")
+
+	lines := collect(t, stream, true)
+	require.Equal(t, []Line{{Text: "^anchored line"}, {Text: "another"}}, lines)
+}
+
+func TestOversizedLineIsTruncated(t *testing.T) {
+	long := strings.Repeat("x", maxLineBytes+100)
+	stream := strings.NewReader(long + "\nnext\n")
+
+	lines := collect(t, stream, true)
+	require.Len(t, lines, 2)
+	require.Len(t, lines[0].Text, maxLineBytes)
+	require.Equal(t, "next", lines[1].Text)
+}
+
+func TestStreamStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	lines := streamLines(ctx, strings.NewReader("one\ntwo\nthree\n"), true)
+
+	first := <-lines
+	require.Equal(t, "one", first.Text)
+	cancel()
+
+	for line := range lines {
+		require.NoError(t, line.Err)
+	}
+}
@@ -6,16 +6,22 @@ import (
 	"io"
 	"log"
 	"os"
+	"path"
 	"regexp"
-	"strings"
 	"time"
 
 	"github.com/elireisman/whalewatcher/config"
 
 	docker_types "github.com/docker/docker/api/types"
-	docker_filters "github.com/docker/docker/api/types/filters"
 	docker "github.com/docker/docker/client"
-	"github.com/hpcloud/tail"
+)
+
+const (
+	// placeholder container ID until the target container is discovered
+	unknownID = "UNKNOWN"
+
+	// number of trailing log lines reported when a target container exits
+	exitLogLines = 10
 )
 
 // performs the log monitoring and status publishing for one service container
@@ -25,20 +31,54 @@ type Tailer struct {
 	ID           string
 	Since        time.Duration
 	Patterns     []*regexp.Regexp
+	Failures     []*regexp.Regexp
 	AwaitStartup time.Duration
 	AwaitReady   time.Duration
+	OnTimeout    string
+	Continuous   bool
+	Restarts     int
+
+	// if set, the target container is selected by its compose labels and/or
+	// a glob on its name, rather than by Name
+	Service string
+	Project string
+	Match   string
+
+	// if set, the tailer monitors this one replica of a replicated target
+	Replica string
+
+	// checks run against the container alongside its log stream, and how
+	// their results combine with the patterns to determine readiness
+	Probes    []*probe
+	ReadyWhen string
 
 	Publisher *Publisher
-	Client    *docker.Client
-	Driver    *tail.Tail
+	Discovery *Discovery
+	Client    docker.APIClient
 	Reader    io.ReadCloser
-	Writer    *os.File
+	TTY       bool
+
+	Logger    *log.Logger
+	lifecycle *lifecycle
+	recent    []string
 
-	Logger *log.Logger
-	Done   chan bool
+	// readiness signals seen from the current container instance
+	logsMatched bool
+	probeStatus map[string]ProbeStatus
 }
 
-func New(ctx context.Context, client *docker.Client, pub *Publisher, containerName string, target config.Container, awaitStartup time.Duration) (*Tailer, error) {
+func New(ctx context.Context, client docker.APIClient, disco *Discovery, pub *Publisher, containerName string, target config.Container, awaitStartup time.Duration) (*Tailer, error) {
+	t, err := build(ctx, client, disco, pub, containerName, target, awaitStartup)
+	if err != nil {
+		return nil, err
+	}
+
+	t.register()
+	return t, nil
+}
+
+// validate the target's config and build its tailer, without yet publishing anything
+func build(ctx context.Context, client docker.APIClient, disco *Discovery, pub *Publisher, containerName string, target config.Container, awaitStartup time.Duration) (*Tailer, error) {
 	logger := log.New(os.Stdout, fmt.Sprintf("[monitoring: %s] ", containerName), log.LstdFlags)
 
 	// use global startup wait default for warmup wait unless override supplied in config
@@ -58,75 +98,108 @@ func New(ctx context.Context, client *docker.Client, pub *Publisher, containerNa
 		logger.Printf("INFO limiting log stream to window: now - %s", since)
 	}
 
+	// the outcome to publish if no pattern matches within the ready wait
+	onTimeout := target.OnTimeout
+	if len(onTimeout) == 0 {
+		onTimeout = config.OnTimeoutReady
+	}
+	if !config.ValidOnTimeout(onTimeout) {
+		return nil, fmt.Errorf("invalid on_timeout policy %q: expected one of %s, %s, %s",
+			onTimeout, config.OnTimeoutReady, config.OnTimeoutError, config.OnTimeoutTimedOut)
+	}
+
+	// one-shot monitoring unless the target opts into following container restarts
+	if len(target.Mode) > 0 && target.Mode != config.ModeOnce && target.Mode != config.ModeContinuous {
+		return nil, fmt.Errorf("invalid mode %q: expected one of %s, %s", target.Mode, config.ModeOnce, config.ModeContinuous)
+	}
+
+	// how log patterns and probes combine to decide the target is ready
+	if err := target.ValidateReadiness(); err != nil {
+		return nil, err
+	}
+	readyWhen := target.Readiness()
+	probes, err := buildProbes(client, target, logger)
+	if err != nil {
+		return nil, err
+	}
+
 	// parse, compile, cache all the specified regex patterns
 	checks, err := extractPatterns(target, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile regex patterns: %s", err)
 	}
-
-	// register the specified service under it's container_name
-	pub.Add(containerName, Status{})
-	logger.Println("INFO container registered for monitoring")
+	failures, err := compilePatterns(target.FailurePatterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile failure regex patterns: %s", err)
+	}
 
 	// the remaining fields will be populated when Start() is called
-	return &Tailer{
+	t := &Tailer{
 		Ctx:          ctx,
 		Name:         containerName,
-		ID:           "UNKNOWN",
+		ID:           unknownID,
 		Since:        since,
 		Patterns:     checks,
+		Failures:     failures,
 		AwaitStartup: awaitStartup,
 		AwaitReady:   awaitReady,
+		OnTimeout:    onTimeout,
+		Continuous:   target.Mode == config.ModeContinuous,
+		Service:      target.Service,
+		Project:      target.Project,
+		Match:        target.Match,
+		Probes:       probes,
+		ReadyWhen:    readyWhen,
 		Publisher:    pub,
+		Discovery:    disco,
 		Client:       client,
 		Logger:       logger,
-		Done:         make(chan bool),
-	}, nil
+		lifecycle:    newLifecycle(),
+	}
+
+	return t, nil
+}
+
+// register the specified service under it's container_name
+func (t *Tailer) register() {
+	t.transition(PhaseRegistered, Status{})
+	t.Logger.Println("INFO container registered for monitoring")
 }
 
 // caller should execute this in a goroutine
 func (t *Tailer) Start() {
+	sub := t.Discovery.Subscribe(t.matches)
+	defer sub.Close()
+
 	// await target container startup and obtain container ID for this run
-	if !t.obtainIDForRunningContainer() {
+	if !t.obtainIDForRunningContainer(sub) {
 		return
 	}
 
-	// build pipeline to stream target container's logs into local tailer
-	pipeFile := pipeName(t.Name, t.ID)
-	if !t.buildLogPipeline(pipeFile) {
-		return
+	// in continuous mode, follow the target across container restarts
+	for t.tail(sub) && t.Continuous {
+		if !t.awaitRestart(sub) {
+			return
+		}
 	}
+}
 
-	defer func() {
-		// tear down the tailer (named pipe -> log tailer)
-		t.Driver.Cleanup()
-		// trigger the Docker (log stream -> named pipe) to tear down
-		close(t.Done)
-	}()
-
-	// copy log stream from Docker client into named pipe for tailer to consume
-	go func() {
-		defer func() {
-			t.Writer.Close()
-			t.Reader.Close()
-		}()
-
-		for {
-			select {
-			case <-t.Done:
-				t.Logger.Printf("INFO named pipe %s closing", pipeFile)
-				return
-
-			default:
-				if _, err := io.Copy(t.Writer, t.Reader); err != nil {
-					t.Logger.Printf("ERROR copying container logs to named pipe %s: %s", pipeFile, err)
-				}
-			}
-		}
-	}()
+// tail the current container instance's logs until the context is canceled
+// (global shutdown triggered) an unrecoverable tailing error occurs, a matching
+// log line is found, or the wait times out. returns false on shutdown
+func (t *Tailer) tail(sub *Subscription) bool {
+	// open the target container's log stream and split it into lines in the background
+	if !t.openLogStream() {
+		return t.Ctx.Err() == nil
+	}
+	defer t.Reader.Close()
+	t.transition(PhaseStreaming, Status{})
+
+	streamCtx, stopStream := context.WithCancel(t.Ctx)
+	defer stopStream()
+	lines := streamLines(streamCtx, t.Reader, t.TTY)
+	probes := runProbes(streamCtx, t.Probes, t.ID)
 
-	// consume log lines until the context is canceled (global shutdown triggered)
-	// an unrecoverable tailing error occurs, or a matching log line is found
 	lineCount := 0
 	timeoutCtx, cleanup := context.WithTimeout(t.Ctx, t.AwaitReady)
 	defer cleanup()
@@ -139,135 +212,393 @@ func (t *Tailer) Start() {
 		case <-timeoutCtx.Done():
 			t.Logger.Printf("INFO tailer shutting down after awaiting ready status for %s: %s",
 				time.Since(start), timeoutCtx.Err())
-			now := time.Now().UTC()
-			t.Publisher.Add(t.Name, Status{
-				Ready: true,
-				At:    &now,
-			})
-			return
+			if t.Ctx.Err() != nil {
+				t.shutdown()
+				return false
+			}
+			t.PublishTimeout()
+			return true
 
-		case line, ok := <-t.Driver.Lines:
-			lineCount++
+		case line, ok := <-lines:
 			if !ok {
+				if t.Ctx.Err() != nil {
+					t.shutdown()
+					return false
+				}
 				t.Logger.Println("INFO tailer shutting down (feed closed)")
-				return
+				t.publishExit(true)
+				return true
 			}
 
-			if t.ProcessLine(line, lineCount) {
+			lineCount++
+			if t.ProcessLine(&line, lineCount) {
 				t.Logger.Printf("INFO tailing completed at line %d for service, shutting down", lineCount)
-				return
+				return true
+			}
+
+		case res := <-probes:
+			if t.probed(res) {
+				t.Logger.Printf("INFO %s probe passed, tailing completed for service, shutting down", res.kind)
+				return true
+			}
+
+		case evt := <-sub.Events:
+			// docker reported a healthcheck result, don't wait for the next poll to see it
+			if evt.Action == ActionHealthStatus {
+				if evt.Container.ID == t.ID && t.probeNow(ProbeHealthcheck) {
+					t.Logger.Println("INFO container healthy, tailing completed for service, shutting down")
+					return true
+				}
+				continue
+			}
+
+			// a replacement container came up while we were still tailing the old one,
+			// or the same container was restarted in place (i.e. docker restart)
+			if t.Continuous && evt.Container.Running && t.matches(evt.Container) &&
+				(evt.Container.ID != t.ID || evt.Action == ActionStart) {
+				t.restarted(evt.Container)
+				return true
+			}
+		}
+	}
+}
+
+// in continuous mode, wait for the current container to exit and a new
+// instance of the target to start. returns false on shutdown
+func (t *Tailer) awaitRestart(sub *Subscription) bool {
+	// a replacement was already found while tailing the previous instance
+	if t.lifecycle.phase == PhaseAwaitingContainer {
+		return true
+	}
+	t.Logger.Printf("INFO watching container %s for restarts", t.ID)
+
+	for {
+		select {
+		case <-t.Ctx.Done():
+			t.shutdown()
+			return false
+
+		case evt := <-sub.Events:
+			info := evt.Container
+			switch {
+			case info.ID == t.ID && !info.Running:
+				if t.lifecycle.phase != PhaseContainerExited {
+					t.Logger.Printf("WARN container %s exited (%s)", t.ID, evt.Action)
+					t.publishExit(false)
+				}
+
+			// Discovery only relays a start for a container it knew had stopped, so a start
+			// with the current ID is a restart in place, even if its exit was never published
+			case info.Running && t.matches(info) &&
+				(info.ID != t.ID || t.lifecycle.phase == PhaseContainerExited || evt.Action == ActionStart):
+				t.restarted(info)
+				return true
 			}
 		}
 	}
 }
 
+// reset the target to not-ready and begin monitoring a new container instance
+func (t *Tailer) restarted(info ContainerInfo) {
+	if t.lifecycle.phase != PhaseContainerExited {
+		t.transition(PhaseContainerExited, Status{})
+	}
+
+	t.ID = info.ID
+	t.Restarts++
+	t.recent = nil
+	t.logsMatched = false
+	t.probeStatus = nil
+	t.Logger.Printf("INFO container restarted as %s (restart %d), re-evaluating patterns", t.ID, t.Restarts)
+	t.transition(PhaseAwaitingContainer, Status{})
+}
+
 // handle processing each log line, publish result if error or match occurs
-func (t *Tailer) ProcessLine(line *tail.Line, lineCount int) bool {
+func (t *Tailer) ProcessLine(line *Line, lineCount int) bool {
+	if line.Err == nil {
+		t.remember(line.Text)
+	}
+
 	if line.Err != nil {
 		t.Logger.Printf("ERROR while tailing log for service: %s", line.Err)
-		now := time.Now().UTC()
-		t.Publisher.Add(t.Name, Status{
-			At:    &now,
-			Error: line.Err.Error(),
-		})
+		t.transition(PhaseFailed, Status{Error: line.Err.Error()})
 		return true
 	}
 
+	// a fatal log line fails the target immediately, rather than at timeout
+	for _, pattern := range t.Failures {
+		if pattern.MatchString(line.Text) {
+			t.Logger.Printf("ERROR failure pattern matched at line %d: %s", lineCount, line.Text)
+			t.transition(PhaseFailed, Status{
+				Error: fmt.Sprintf("failure pattern %q matched at line %d", pattern, lineCount),
+				Line:  line.Text,
+			})
+			return true
+		}
+	}
+
+	if t.logsMatched {
+		return false
+	}
 	for _, pattern := range t.Patterns {
 		if pattern.MatchString(line.Text) {
 			t.Logger.Printf("INFO target pattern matched at line %d: %s", lineCount, line.Text)
+			t.logsMatched = true
+			if t.satisfied() {
+				t.transition(PhaseReady, Status{})
+				return true
+			}
+			t.Logger.Printf("INFO awaiting probes per ready_when policy %q", t.ReadyWhen)
+			t.publish(Status{}, time.Now().UTC())
+			return false
+		}
+	}
 
-			now := time.Now().UTC()
-			t.Publisher.Add(t.Name, Status{
-				Ready: true,
-				At:    &now,
-			})
-			return true
+	return false
+}
+
+// record and publish a probe attempt's outcome, counting consecutive
+// failures. returns true once the target is ready
+func (t *Tailer) probed(res probeResult) bool {
+	prev, seen := t.probeStatus[res.kind]
+	if t.probeStatus == nil {
+		t.probeStatus = map[string]ProbeStatus{}
+	}
+	if !res.status.OK {
+		res.status.Failures = prev.Failures + 1
+	}
+	t.probeStatus[res.kind] = res.status
+
+	if t.satisfied() {
+		t.transition(PhaseReady, Status{})
+		return true
+	}
+
+	// repeated attempts with the same outcome only update the failure count and
+	// latency, which are published along with the next change
+	if seen && prev.OK == res.status.OK && prev.Error == res.status.Error && prev.Response == res.status.Response {
+		return false
+	}
+
+	if !seen || prev.OK != res.status.OK || prev.Error != res.status.Error {
+		if res.status.OK {
+			t.Logger.Printf("INFO %s probe passed", res.kind)
+		} else {
+			t.Logger.Printf("WARN %s probe failed: %s", res.kind, res.status.Error)
 		}
 	}
+	t.publish(Status{}, time.Now().UTC())
+	return false
+}
 
+// run one of the target's probes immediately, if it has one of the kind.
+// returns true once the target is ready
+func (t *Tailer) probeNow(kind string) bool {
+	for _, p := range t.Probes {
+		if p.kind == kind {
+			return t.probed(p.attempt(t.Ctx, t.ID))
+		}
+	}
 	return false
 }
 
-func (t *Tailer) buildLogPipeline(pipeFile string) bool {
-	var err error
+// report whether the target is ready, combining the log pattern match and
+// the probe results per the target's ready_when policy
+func (t *Tailer) satisfied() bool {
+	probesOK := len(t.Probes) > 0
+	for _, p := range t.Probes {
+		if !t.probeStatus[p.kind].OK {
+			probesOK = false
+		}
+	}
 
-	// wire up the log stream from the container to our monitor
-	opts := docker_types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Follow:     true,
+	switch t.ReadyWhen {
+	case config.ReadyWhenProbe:
+		return probesOK
+	case config.ReadyWhenAll:
+		return t.logsMatched && probesOK
+	case config.ReadyWhenAny:
+		return t.logsMatched || probesOK
 	}
-	if t.Since != time.Duration(0) {
-		opts.Since = time.Now().Add(-t.Since).Format(time.RFC3339)
-		t.Logger.Printf("INFO filtering log stream for lines no older than %s", t.Since)
+	return t.logsMatched
+}
+
+// retain the last few log lines, to explain an unexpected container exit
+func (t *Tailer) remember(text string) {
+	t.recent = append(t.recent, text)
+	if len(t.recent) > exitLogLines {
+		t.recent = t.recent[len(t.recent)-exitLogLines:]
 	}
+}
 
-	t.Reader, err = t.Client.ContainerLogs(t.Ctx, t.ID, opts)
+// inspect the target container once it's gone away, publishing why it exited.
+// the most recent log lines are included if it exited while being tailed
+func (t *Tailer) publishExit(withLines bool) {
+	info, err := t.Client.ContainerInspect(t.Ctx, t.ID)
 	if err != nil {
-		t.publishError(err, "failed to obtain reader for container log stream")
-		return false
+		if t.Ctx.Err() != nil {
+			t.shutdown()
+			return
+		}
+		t.publishError(err, "container %s went away, and failed to inspect it", t.ID)
+		return
 	}
 
-	// use a named pipe to stream the log output into a form the tailer can accept
-	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
-	t.Writer, err = os.OpenFile(pipeFile, flags, os.ModeNamedPipe)
+	if info.State == nil || info.State.Running {
+		t.transition(PhaseFailed, Status{Error: "log stream closed while container was still running"})
+		return
+	}
+
+	var lines []string
+	if withLines {
+		lines = t.recent
+	}
+	status := exitStatus(info.State, lines)
+	t.Logger.Println("ERROR " + status.Error)
+	t.transition(PhaseContainerExited, status)
+}
+
+// summarize a stopped container's state as a failure status
+func exitStatus(state *docker_types.ContainerState, lines []string) Status {
+	exit := &ExitInfo{
+		Code:      state.ExitCode,
+		OOMKilled: state.OOMKilled,
+		LastLines: append([]string(nil), lines...),
+	}
+	if finished, err := time.Parse(time.RFC3339Nano, state.FinishedAt); err == nil && !finished.IsZero() {
+		finished = finished.UTC()
+		exit.FinishedAt = &finished
+	}
+
+	msg := fmt.Sprintf("container exited with code %d", exit.Code)
+	if exit.OOMKilled {
+		msg += " (OOM killed)"
+	}
+	if len(state.Error) > 0 {
+		msg += ": " + state.Error
+	}
+
+	return Status{Error: msg, Exit: exit}
+}
+
+// publish the outcome dictated by the target's on_timeout policy
+// when no pattern matched within the ready wait
+func (t *Tailer) PublishTimeout() {
+	status := Status{TimedOut: true}
+
+	switch t.OnTimeout {
+	case config.OnTimeoutReady:
+		t.Logger.Printf("INFO no pattern matched in %s, marking ready per on_timeout policy", t.AwaitReady)
+		t.transition(PhaseReady, status)
+
+	case config.OnTimeoutError:
+		status.Error = fmt.Sprintf("no pattern matched within %s", t.AwaitReady)
+		t.Logger.Println("ERROR " + status.Error)
+		t.transition(PhaseFailed, status)
+
+	default:
+		t.Logger.Printf("WARN no pattern matched in %s, marking timed out", t.AwaitReady)
+		t.transition(PhaseTimedOut, status)
+	}
+}
+
+// open the target container's log stream, noting whether it's multiplexed
+func (t *Tailer) openLogStream() bool {
+	info, err := t.Client.ContainerInspect(t.Ctx, t.ID)
 	if err != nil {
-		t.publishError(err, "failed to open named pipe %s", pipeFile)
+		t.publishError(err, "failed to inspect container %s", t.ID)
 		return false
 	}
+	t.TTY = info.Config != nil && info.Config.Tty
 
-	// wire up the tailer
-	tailCfg := tail.Config{
-		Logger:    t.Logger,
-		MustExist: true,
-		Follow:    true,
-		Pipe:      true,
+	opts := docker_types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	}
+
+	var since time.Time
+	if t.Since != time.Duration(0) {
+		since = time.Now().Add(-t.Since)
+		t.Logger.Printf("INFO filtering log stream for lines no older than %s", t.Since)
+	}
+	// after a restart, don't re-match lines logged by a previous run of the same container
+	if t.Restarts > 0 && info.State != nil {
+		started, err := time.Parse(time.RFC3339Nano, info.State.StartedAt)
+		if err == nil && started.After(since) {
+			since = started
+		}
 	}
-	t.Driver, err = tail.TailFile(pipeFile, tailCfg)
+	if !since.IsZero() {
+		opts.Since = since.Format(time.RFC3339Nano)
+	}
+
+	t.Reader, err = t.Client.ContainerLogs(t.Ctx, t.ID, opts)
 	if err != nil {
-		t.publishError(err, "failed to tail container logs from pipe %s", pipeFile)
+		t.publishError(err, "failed to obtain reader for container log stream")
 		return false
 	}
 
 	return true
 }
 
-// obtain the container ID for the target service, once it's up
-func (t *Tailer) obtainIDForRunningContainer() bool {
+// obtain the container ID for the target service, once Discovery reports it's up
+func (t *Tailer) obtainIDForRunningContainer(sub *Subscription) bool {
 	t.Logger.Printf("INFO awaiting container startup for interval: %s", t.AwaitStartup)
+	t.transition(PhaseAwaitingContainer, Status{})
 
 	timeoutCtx, cancelable := context.WithTimeout(t.Ctx, t.AwaitStartup)
 	defer cancelable()
 
-	ticker := time.NewTicker(3 * time.Second)
-	defer ticker.Stop()
-
-FindIDLoop:
 	for {
 		select {
 		case <-timeoutCtx.Done():
-			t.publishError(timeoutCtx.Err(), "failed to obtain container ID for %s in %s", t.Name, t.AwaitStartup)
+			if t.Ctx.Err() != nil {
+				t.shutdown()
+			} else {
+				t.publishError(timeoutCtx.Err(), "failed to obtain container ID for %s in %s", t.Name, t.AwaitStartup)
+			}
 			return false
 
-		case <-ticker.C:
-			opts := docker_types.ContainerListOptions{Filters: docker_filters.NewArgs()}
-			opts.Filters.Add("status", "running")
-
-			containers, err := t.Client.ContainerList(timeoutCtx, opts)
-			if err != nil {
-				t.Logger.Printf("WARN failed to obtain container listing: %s", err)
-				continue
+		case evt := <-sub.Events:
+			if evt.Container.Running && t.matches(evt.Container) {
+				t.ID = evt.Container.ID
+				t.Logger.Printf("INFO container %s is up", t.ID)
+				return true
 			}
+		}
+	}
+}
 
-			for _, container := range containers {
-				if t.Name == strings.TrimPrefix(container.Names[0], "/") {
-					t.ID = container.ID
-					t.Logger.Printf("INFO container %s is up", t.ID)
-					break FindIDLoop
-				}
-			}
-			t.Logger.Println("INFO awaiting container startup")
+// report whether a container discovered on the host is this tailer's target.
+// a replica's tailer follows only the container it was assigned
+func (t *Tailer) matches(info ContainerInfo) bool {
+	if len(t.Replica) > 0 {
+		return info.ID == t.ID
+	}
+	return selects(info, t.Name, t.Service, t.Project, t.Match)
+}
+
+// report whether a container is selected by a target's compose service and
+// name glob, or if it has neither, by its name. without a project, a service
+// in any compose project will match
+func selects(info ContainerInfo, name, service, project, match string) bool {
+	if len(service) == 0 && len(match) == 0 {
+		return info.Name == name
+	}
+
+	if len(service) > 0 {
+		if len(project) > 0 && info.Labels[config.ComposeProjectLabel] != project {
+			return false
+		}
+		if info.Labels[config.ComposeServiceLabel] != service {
+			return false
+		}
+	}
+
+	if len(match) > 0 {
+		if ok, _ := path.Match(match, info.Name); !ok {
+			return false
 		}
 	}
 
@@ -275,15 +606,21 @@ FindIDLoop:
 }
 
 func extractPatterns(target config.Container, logger *log.Logger) ([]*regexp.Regexp, error) {
-	var found bool
-	checks := []*regexp.Regexp{}
-
 	if len(target.Pattern) > 0 {
 		target.Patterns = append(target.Patterns, target.Pattern)
 	}
 
-	for _, pattern := range target.Patterns {
-		found = true
+	if len(target.Patterns) == 0 && target.Readiness() != config.ReadyWhenProbe {
+		return nil, fmt.Errorf("at least one regex pattern is required")
+	}
+
+	return compilePatterns(target.Patterns)
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	checks := []*regexp.Regexp{}
+
+	for _, pattern := range patterns {
 		check, err := regexp.Compile(pattern)
 		if err != nil {
 			return nil, err
@@ -291,20 +628,65 @@ func extractPatterns(target config.Container, logger *log.Logger) ([]*regexp.Reg
 		checks = append(checks, check)
 	}
 
-	if !found {
-		return nil, fmt.Errorf("at least one regex pattern is required")
-	}
-
 	return checks, nil
 }
 
 func (t *Tailer) publishError(err error, format string, args ...interface{}) {
 	msg := fmt.Sprintf(format+": "+err.Error(), args...)
 	t.Logger.Println("ERROR " + msg)
+	t.transition(PhaseFailed, Status{Error: msg})
+}
+
+// publish that the target failed outright, i.e. its monitor crashed
+func (t *Tailer) fail(msg string) {
 	now := time.Now().UTC()
-	t.Publisher.Add(t.Name, Status{At: &now, Error: msg})
+	t.lifecycle.crash(now)
+	t.publish(Status{Error: msg}, now)
 }
 
-func pipeName(containerName, containerID string) string {
-	return fmt.Sprintf("%s_%s_ww", containerName, containerID)
+// publish that monitoring was abandoned due to whalewatcher shutting down
+func (t *Tailer) shutdown() {
+	t.Logger.Println("INFO tailer shutting down (shutdown requested)")
+	t.transition(PhaseShuttingDown, Status{})
+}
+
+// move the tailer to the next lifecycle phase and publish the resulting status.
+// Ready is derived from the phase so the two can never disagree
+func (t *Tailer) transition(next Phase, status Status) bool {
+	now := time.Now().UTC()
+	if err := t.lifecycle.enter(next, now); err != nil {
+		t.Logger.Printf("ERROR %s", err)
+		return false
+	}
+
+	t.publish(status, now)
+	return true
+}
+
+// publish the tailer's current phase, along with the details in status
+func (t *Tailer) publish(status Status, now time.Time) {
+	next := t.lifecycle.phase
+	status.Ready = next == PhaseReady
+	status.Restarts = t.Restarts
+	if t.ID != unknownID {
+		status.ContainerID = t.ID
+	}
+	status.Phase = next
+	status.Entered = t.lifecycle.history()
+	if status.At == nil {
+		status.At = &now
+	}
+	if len(t.Probes) > 0 {
+		status.LogsMatched = t.logsMatched
+		status.Probes = make(map[string]ProbeStatus, len(t.probeStatus))
+		for kind, probe := range t.probeStatus {
+			status.Probes[kind] = probe
+		}
+	}
+
+	if len(t.Replica) > 0 {
+		t.Publisher.AddReplica(t.Name, t.Replica, status)
+	} else {
+		t.Publisher.Add(t.Name, status)
+	}
 }
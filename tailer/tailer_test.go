@@ -3,22 +3,100 @@ package tailer
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/elireisman/whalewatcher/config"
 
-	"github.com/hpcloud/tail"
+	docker_types "github.com/docker/docker/api/types"
+	docker_container "github.com/docker/docker/api/types/container"
+	docker "github.com/docker/docker/client"
 	"github.com/stretchr/testify/require"
 )
 
+// stands in for the Docker API, answering container inspections and log requests from fixtures
+type fakeDocker struct {
+	docker.APIClient
+	containers map[string]docker_types.ContainerJSON
+	logs       map[string]string
+
+	// if set, log streams stay open after serving the fixture logs, until ctx is done
+	follow bool
+
+	// the output and exit code of any command exec'd in a container
+	execOutput string
+	execCode   int
+	execCmd    []string
+
+	// the contents of files inside every container, by path
+	files map[string]string
+
+	// containers whose log streams crash the tailer reading them
+	crash map[string]bool
+}
+
+func (f *fakeDocker) ContainerLogs(ctx context.Context, id string, opts docker_types.ContainerLogsOptions) (io.ReadCloser, error) {
+	if f.crash[id] {
+		panic("log stream for " + id + " crashed")
+	}
+	if !f.follow {
+		return ioutil.NopCloser(strings.NewReader(f.logs[id])), nil
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		io.WriteString(w, f.logs[id])
+		<-ctx.Done()
+		w.Close()
+	}()
+	return r, nil
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, id string) (docker_types.ContainerJSON, error) {
+	info, ok := f.containers[id]
+	if !ok {
+		return info, fmt.Errorf("no such container: %s", id)
+	}
+	return info, nil
+}
+
+func exitedContainer(id string, code int) docker_types.ContainerJSON {
+	return docker_types.ContainerJSON{
+		ContainerJSONBase: &docker_types.ContainerJSONBase{
+			ID:    id,
+			State: &docker_types.ContainerState{Status: "exited", ExitCode: code},
+		},
+	}
+}
+
+// a running container with a TTY, so its fixture logs are served as plain text
+func runningContainer(id string) docker_types.ContainerJSON {
+	return docker_types.ContainerJSON{
+		ContainerJSONBase: &docker_types.ContainerJSONBase{
+			ID:    id,
+			State: &docker_types.ContainerState{Status: "running", Running: true},
+		},
+		Config: &docker_container.Config{Tty: true},
+	}
+}
+
+// drive a tailer into the streaming phase, as Start does once the log stream is open
+func requireStreaming(t *testing.T, tailer *Tailer) {
+	require.True(t, tailer.transition(PhaseAwaitingContainer, Status{}))
+	require.True(t, tailer.transition(PhaseStreaming, Status{}))
+}
+
 func TestLineMatch(t *testing.T) {
 	targetConf := config.Container{Pattern: `[Tt]est x?foo \d+$`}
 	pub := NewPublisher()
-	tailer, err := New(context.TODO(), nil, pub, "foo", targetConf, time.Second)
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
 	require.NoError(t, err)
+	requireStreaming(t, tailer)
 
-	line := &tail.Line{Text: "this is a Test foo 123"}
+	line := &Line{Text: "this is a Test foo 123"}
 	tailer.ProcessLine(line, 1)
 
 	require.True(t, pub.state["foo"].Ready)
@@ -32,10 +110,11 @@ func TestLineMatchMultiPattern(t *testing.T) {
 		},
 	}
 	pub := NewPublisher()
-	tailer, err := New(context.TODO(), nil, pub, "foo", targetConf, time.Second)
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
 	require.NoError(t, err)
+	requireStreaming(t, tailer)
 
-	line := &tail.Line{Text: "this is a Test foo 123"}
+	line := &Line{Text: "this is a Test foo 123"}
 	tailer.ProcessLine(line, 1)
 
 	require.True(t, pub.state["foo"].Ready)
@@ -44,14 +123,15 @@ func TestLineMatchMultiPattern(t *testing.T) {
 func TestLineNoMatch(t *testing.T) {
 	targetConf := config.Container{Pattern: `[Tt]est \d+`}
 	pub := NewPublisher()
-	tailer, err := New(context.TODO(), nil, pub, "foo", targetConf, time.Second)
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
 	require.NoError(t, err)
+	requireStreaming(t, tailer)
 
-	line := &tail.Line{Text: "no similarity to speak of"}
+	line := &Line{Text: "no similarity to speak of"}
 	tailer.ProcessLine(line, 1)
 	require.False(t, pub.state["foo"].Ready)
 
-	line = &tail.Line{Text: "test 2"}
+	line = &Line{Text: "test 2"}
 	tailer.ProcessLine(line, 2)
 	require.True(t, pub.state["foo"].Ready)
 }
@@ -59,11 +139,12 @@ func TestLineNoMatch(t *testing.T) {
 func TestLineMatchWithMaxWaitOverride(t *testing.T) {
 	targetConf := config.Container{Pattern: `[Tt]est x?foo \d+$`, MaxWaitMillis: 2000}
 	pub := NewPublisher()
-	tailer, err := New(context.TODO(), nil, pub, "foo", targetConf, time.Second)
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
 	require.NoError(t, err)
+	requireStreaming(t, tailer)
 	require.Equal(t, 2*time.Second, tailer.AwaitReady)
 
-	line := &tail.Line{Text: "this is a Test foo 123"}
+	line := &Line{Text: "this is a Test foo 123"}
 	tailer.ProcessLine(line, 1)
 
 	require.True(t, pub.state["foo"].Ready)
@@ -72,11 +153,12 @@ func TestLineMatchWithMaxWaitOverride(t *testing.T) {
 func TestLineMatchWithMaxWaitDefault(t *testing.T) {
 	targetConf := config.Container{Pattern: `[Tt]est x?foo \d+$`}
 	pub := NewPublisher()
-	tailer, err := New(context.TODO(), nil, pub, "foo", targetConf, time.Second)
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
 	require.NoError(t, err)
+	requireStreaming(t, tailer)
 	require.Equal(t, tailer.AwaitStartup, tailer.AwaitReady)
 
-	line := &tail.Line{Text: "this is a Test foo 123"}
+	line := &Line{Text: "this is a Test foo 123"}
 	tailer.ProcessLine(line, 1)
 
 	require.True(t, pub.state["foo"].Ready)
@@ -88,11 +170,12 @@ func TestLineMatchWithSinceFilter(t *testing.T) {
 		Since:   "12h",
 	}
 	pub := NewPublisher()
-	tailer, err := New(context.TODO(), nil, pub, "foo", targetConf, time.Second)
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
 	require.NoError(t, err)
+	requireStreaming(t, tailer)
 	require.Equal(t, 12*time.Hour, tailer.Since)
 
-	line := &tail.Line{Text: "this is a Test foo 123"}
+	line := &Line{Text: "this is a Test foo 123"}
 	tailer.ProcessLine(line, 1)
 
 	require.True(t, pub.state["foo"].Ready)
@@ -103,11 +186,12 @@ func TestLineMatchWithSinceDefault(t *testing.T) {
 		Pattern: `[Tt]est x?foo \d+$`,
 	}
 	pub := NewPublisher()
-	tailer, err := New(context.TODO(), nil, pub, "foo", targetConf, time.Second)
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
 	require.NoError(t, err)
+	requireStreaming(t, tailer)
 	require.Equal(t, time.Duration(0), tailer.Since)
 
-	line := &tail.Line{Text: "this is a Test foo 123"}
+	line := &Line{Text: "this is a Test foo 123"}
 	tailer.ProcessLine(line, 1)
 
 	require.True(t, pub.state["foo"].Ready)
@@ -119,19 +203,293 @@ func TestLineMatchWithInvalidSince(t *testing.T) {
 		Since:   "XX__#23",
 	}
 	pub := NewPublisher()
-	_, err := New(context.TODO(), nil, pub, "foo", targetConf, time.Second)
+	_, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
 	require.Error(t, err)
 }
 
 func TestLineError(t *testing.T) {
 	targetConf := config.Container{Pattern: `[Tt]est \d+`}
 	pub := NewPublisher()
-	tailer, err := New(context.TODO(), nil, pub, "foo", targetConf, time.Second)
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
 	require.NoError(t, err)
+	requireStreaming(t, tailer)
 
-	line := &tail.Line{Text: "foo bar baz", Err: fmt.Errorf("oh the humanity")}
+	line := &Line{Text: "foo bar baz", Err: fmt.Errorf("oh the humanity")}
 	tailer.ProcessLine(line, 1)
 
 	require.False(t, pub.state["foo"].Ready)
 	require.NotEmpty(t, pub.state["foo"].Error)
 }
+
+func TestTimeoutDefaultsToReady(t *testing.T) {
+	targetConf := config.Container{Pattern: `[Tt]est \d+`}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+	require.Equal(t, config.OnTimeoutReady, tailer.OnTimeout)
+
+	tailer.PublishTimeout()
+
+	require.True(t, pub.state["foo"].Ready)
+	require.True(t, pub.state["foo"].TimedOut)
+	require.Empty(t, pub.state["foo"].Error)
+}
+
+func TestTimeoutAsError(t *testing.T) {
+	targetConf := config.Container{Pattern: `[Tt]est \d+`, OnTimeout: config.OnTimeoutError}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+
+	tailer.PublishTimeout()
+
+	require.False(t, pub.state["foo"].Ready)
+	require.True(t, pub.state["foo"].TimedOut)
+	require.NotEmpty(t, pub.state["foo"].Error)
+}
+
+func TestTimeoutAsTimedOut(t *testing.T) {
+	targetConf := config.Container{Pattern: `[Tt]est \d+`, OnTimeout: config.OnTimeoutTimedOut}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+
+	tailer.PublishTimeout()
+
+	require.False(t, pub.state["foo"].Ready)
+	require.True(t, pub.state["foo"].TimedOut)
+	require.Empty(t, pub.state["foo"].Error)
+}
+
+func TestInvalidTimeoutPolicy(t *testing.T) {
+	targetConf := config.Container{Pattern: `[Tt]est \d+`, OnTimeout: "shrug"}
+	pub := NewPublisher()
+	_, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.Error(t, err)
+}
+
+func TestPhasesPublished(t *testing.T) {
+	targetConf := config.Container{Pattern: `[Tt]est \d+`}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, PhaseRegistered, pub.state["foo"].Phase)
+
+	requireStreaming(t, tailer)
+	require.Equal(t, PhaseStreaming, pub.state["foo"].Phase)
+	require.False(t, pub.state["foo"].Ready)
+
+	tailer.ProcessLine(&Line{Text: "test 1"}, 1)
+	require.Equal(t, PhaseReady, pub.state["foo"].Phase)
+	require.True(t, pub.state["foo"].Ready)
+	require.Contains(t, pub.state["foo"].Entered, PhaseRegistered)
+	require.Contains(t, pub.state["foo"].Entered, PhaseAwaitingContainer)
+	require.Contains(t, pub.state["foo"].Entered, PhaseStreaming)
+	require.Contains(t, pub.state["foo"].Entered, PhaseReady)
+
+	// a status can't regress from ready to failed
+	tailer.ProcessLine(&Line{Err: fmt.Errorf("late error")}, 2)
+	require.Equal(t, PhaseReady, pub.state["foo"].Phase)
+	require.Empty(t, pub.state["foo"].Error)
+}
+
+func TestContinuousModeFollowsRestart(t *testing.T) {
+	targetConf := config.Container{Pattern: `[Tt]est \d+`, Mode: config.ModeContinuous}
+	pub := NewPublisher()
+	disco := NewDiscovery(nil)
+	client := &fakeDocker{containers: map[string]docker_types.ContainerJSON{"abc": exitedContainer("abc", 1)}}
+	tailer, err := New(context.TODO(), client, disco, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	require.True(t, tailer.Continuous)
+
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true})
+	sub := disco.Subscribe(tailer.matches)
+	defer sub.Close()
+	require.True(t, tailer.obtainIDForRunningContainer(sub))
+	require.Equal(t, "abc", tailer.ID)
+
+	require.True(t, tailer.transition(PhaseStreaming, Status{}))
+	tailer.ProcessLine(&Line{Text: "test 1"}, 1)
+	require.True(t, pub.state["foo"].Ready)
+	require.Equal(t, "abc", pub.state["foo"].ContainerID)
+
+	// container dies and a new instance starts: status resets to not-ready
+	disco.stopped("abc", ActionDie)
+	disco.started(ContainerInfo{ID: "def", Name: "foo", Running: true})
+	require.True(t, tailer.awaitRestart(sub))
+
+	require.Equal(t, "def", tailer.ID)
+	require.False(t, pub.state["foo"].Ready)
+	require.Equal(t, PhaseAwaitingContainer, pub.state["foo"].Phase)
+	require.Contains(t, pub.state["foo"].Entered, PhaseContainerExited)
+	require.Empty(t, pub.state["foo"].Error)
+	require.Equal(t, 1, pub.state["foo"].Restarts)
+	require.Equal(t, "def", pub.state["foo"].ContainerID)
+
+	// patterns are re-evaluated against the new instance
+	require.True(t, tailer.transition(PhaseStreaming, Status{}))
+	tailer.ProcessLine(&Line{Text: "test 2"}, 1)
+	require.True(t, pub.state["foo"].Ready)
+	require.Equal(t, 1, pub.state["foo"].Restarts)
+}
+
+func TestContinuousModeFollowsRestartInPlace(t *testing.T) {
+	targetConf := config.Container{Pattern: `never matches`, Mode: config.ModeContinuous}
+	pub := NewPublisher()
+	disco := NewDiscovery(nil)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	client := &fakeDocker{follow: true, containers: map[string]docker_types.ContainerJSON{"abc": runningContainer("abc")}}
+	tailer, err := New(ctx, client, disco, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true})
+	sub := disco.Subscribe(tailer.matches)
+	defer sub.Close()
+	require.True(t, tailer.obtainIDForRunningContainer(sub))
+
+	// docker restart keeps the container ID, and both its events can arrive
+	// while the old log stream is still open
+	disco.stopped("abc", ActionDie)
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true})
+	require.True(t, tailer.tail(sub))
+	require.True(t, tailer.awaitRestart(sub))
+
+	status := pub.state["foo"]
+	require.Equal(t, PhaseAwaitingContainer, status.Phase)
+	require.Contains(t, status.Entered, PhaseContainerExited)
+	require.Equal(t, 1, status.Restarts)
+	require.Equal(t, "abc", tailer.ID)
+
+	// and once ready, a restart in place is followed without seeing the exit published
+	require.True(t, tailer.transition(PhaseStreaming, Status{}))
+	tailer.ProcessLine(&Line{Text: "never matches"}, 1)
+	require.True(t, pub.state["foo"].Ready)
+	disco.stopped("abc", ActionDie)
+	disco.started(ContainerInfo{ID: "abc", Name: "foo", Running: true})
+	<-sub.Events
+	require.True(t, tailer.awaitRestart(sub))
+	require.Equal(t, PhaseAwaitingContainer, pub.state["foo"].Phase)
+	require.Equal(t, 2, pub.state["foo"].Restarts)
+}
+
+func TestContinuousModeShutdownWhileReady(t *testing.T) {
+	targetConf := config.Container{Pattern: `[Tt]est \d+`, Mode: config.ModeContinuous}
+	pub := NewPublisher()
+	disco := NewDiscovery(nil)
+	ctx, cancel := context.WithCancel(context.TODO())
+	tailer, err := New(ctx, nil, disco, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+	tailer.ProcessLine(&Line{Text: "test 1"}, 1)
+
+	sub := disco.Subscribe(tailer.matches)
+	defer sub.Close()
+	cancel()
+
+	require.False(t, tailer.awaitRestart(sub))
+	require.Equal(t, PhaseShuttingDown, pub.state["foo"].Phase)
+}
+
+func TestInvalidMode(t *testing.T) {
+	targetConf := config.Container{Pattern: `[Tt]est \d+`, Mode: "sometimes"}
+	pub := NewPublisher()
+	_, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.Error(t, err)
+}
+
+func TestFailurePatternMatch(t *testing.T) {
+	targetConf := config.Container{
+		Pattern:         `ready for connections`,
+		FailurePatterns: []string{`OutOfMemoryError`, `^FATAL: `},
+	}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+
+	require.False(t, tailer.ProcessLine(&Line{Text: "starting up"}, 1))
+	require.True(t, tailer.ProcessLine(&Line{Text: "FATAL: password authentication failed"}, 2))
+
+	require.False(t, pub.state["foo"].Ready)
+	require.Equal(t, PhaseFailed, pub.state["foo"].Phase)
+	require.Contains(t, pub.state["foo"].Error, "line 2")
+	require.Equal(t, "FATAL: password authentication failed", pub.state["foo"].Line)
+
+	_, status := pub.GetAll()
+	require.Equal(t, 503, status)
+}
+
+func TestInvalidFailurePattern(t *testing.T) {
+	targetConf := config.Container{Pattern: `ok`, FailurePatterns: []string{`(unclosed`}}
+	pub := NewPublisher()
+	_, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.Error(t, err)
+}
+
+func TestExitStatus(t *testing.T) {
+	state := &docker_types.ContainerState{
+		Status:     "exited",
+		ExitCode:   137,
+		OOMKilled:  true,
+		FinishedAt: "2019-06-19T12:15:33.1721458Z",
+	}
+
+	status := exitStatus(state, []string{"allocating", "allocating more"})
+	require.Equal(t, "container exited with code 137 (OOM killed)", status.Error)
+	require.Equal(t, 137, status.Exit.Code)
+	require.True(t, status.Exit.OOMKilled)
+	require.Equal(t, 2019, status.Exit.FinishedAt.Year())
+	require.Equal(t, []string{"allocating", "allocating more"}, status.Exit.LastLines)
+}
+
+func TestExitStatusWithoutFinishTime(t *testing.T) {
+	state := &docker_types.ContainerState{ExitCode: 1, FinishedAt: "0001-01-01T00:00:00Z"}
+
+	status := exitStatus(state, nil)
+	require.Equal(t, "container exited with code 1", status.Error)
+	require.Nil(t, status.Exit.FinishedAt)
+	require.Empty(t, status.Exit.LastLines)
+}
+
+func TestRecentLinesAreBounded(t *testing.T) {
+	targetConf := config.Container{Pattern: `never matches`}
+	pub := NewPublisher()
+	tailer, err := New(context.TODO(), nil, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+
+	for i := 1; i <= exitLogLines+5; i++ {
+		tailer.ProcessLine(&Line{Text: fmt.Sprintf("line %d", i)}, i)
+	}
+
+	require.Len(t, tailer.recent, exitLogLines)
+	require.Equal(t, "line 6", tailer.recent[0])
+	require.Equal(t, fmt.Sprintf("line %d", exitLogLines+5), tailer.recent[exitLogLines-1])
+}
+
+func TestExitWhileStreamingIsPublished(t *testing.T) {
+	targetConf := config.Container{Pattern: `never matches`}
+	pub := NewPublisher()
+	client := &fakeDocker{containers: map[string]docker_types.ContainerJSON{"abc": exitedContainer("abc", 2)}}
+	tailer, err := New(context.TODO(), client, nil, pub, "foo", targetConf, time.Second)
+	require.NoError(t, err)
+	requireStreaming(t, tailer)
+	tailer.ID = "abc"
+
+	tailer.ProcessLine(&Line{Text: "loading"}, 1)
+	tailer.ProcessLine(&Line{Text: "panic: bad config"}, 2)
+	tailer.publishExit(true)
+
+	status := pub.state["foo"]
+	require.False(t, status.Ready)
+	require.Equal(t, PhaseContainerExited, status.Phase)
+	require.Equal(t, "container exited with code 2", status.Error)
+	require.Equal(t, []string{"loading", "panic: bad config"}, status.Exit.LastLines)
+
+	_, code := pub.GetAll()
+	require.Equal(t, 503, code)
+}
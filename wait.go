@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/elireisman/whalewatcher/waiter"
+)
+
+// the "wait" subcommand: poll a whalewatcher status API until the selected
+// targets are ready, for use as a container entrypoint gate. if a command
+// follows "--" it replaces this process once the targets are ready
+func runWait(args []string) int {
+	flags := flag.NewFlagSet("wait", flag.ContinueOnError)
+	url := flags.String("url", "http://localhost:4444", "base URL of the whalewatcher status API")
+	targets := flags.String("targets", "", "comma separated list of targets to await; all targets if empty")
+	groups := flags.String("groups", "", "comma separated list of target groups to await, in addition to any targets")
+	timeout := flags.Duration("timeout", 2*time.Minute, "maximum time to await the targets")
+
+	if err := flags.Parse(args); err != nil {
+		return waiter.ExitError
+	}
+
+	var selected []string
+	if len(*targets) > 0 {
+		selected = strings.Split(*targets, ",")
+	}
+
+	logger := log.New(os.Stdout, "[wait] ", log.LstdFlags)
+
+	// resolve the command up front, so a typo fails fast rather than after the wait
+	command := flags.Args()
+	var commandPath string
+	if len(command) > 0 {
+		var err error
+		if commandPath, err = exec.LookPath(command[0]); err != nil {
+			logger.Printf("ERROR command not found: %s", err)
+			return waiter.ExitError
+		}
+	}
+
+	// a signal received while waiting abandons the wait, and the command never runs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	w := waiter.New(*url, selected, *timeout, logger)
+	if len(*groups) > 0 {
+		w.Groups = strings.Split(*groups, ",")
+	}
+
+	code := w.Wait(ctx)
+	if code != waiter.ExitReady || len(command) == 0 {
+		return code
+	}
+
+	// exec in place: the command keeps our PID (i.e. PID 1 in a container)
+	// and receives signals directly, with default dispositions restored
+	signal.Reset()
+	logger.Printf("INFO executing %s", strings.Join(command, " "))
+	err := execCommand(commandPath, command)
+
+	logger.Printf("ERROR failed to exec %s: %s", commandPath, err)
+	return waiter.ExitError
+}
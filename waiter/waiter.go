@@ -0,0 +1,197 @@
+package waiter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elireisman/whalewatcher/tailer"
+)
+
+// process exit codes reported by the wait subcommand
+const (
+	ExitReady    = 0
+	ExitError    = 1
+	ExitFailed   = 2
+	ExitNotFound = 3
+	ExitTimeout  = 4
+
+	// the wait was abandoned because the process was signaled
+	ExitInterrupted = 130
+)
+
+// bounds on the interval between status polls
+const (
+	minBackoff = 250 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// polls a whalewatcher status API until the selected targets are ready
+type Waiter struct {
+	URL     string
+	Targets []string
+	Groups  []string
+	Timeout time.Duration
+
+	Client *http.Client
+	Logger *log.Logger
+
+	// last reported state per target, so progress is only logged on change
+	seen map[string]string
+}
+
+func New(baseURL string, targets []string, timeout time.Duration, logger *log.Logger) *Waiter {
+	return &Waiter{
+		URL:     strings.TrimSuffix(baseURL, "/"),
+		Targets: targets,
+		Timeout: timeout,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+		Logger:  logger,
+		seen:    map[string]string{},
+	}
+}
+
+// poll with exponential backoff until the targets are all ready, any fails
+// or isn't registered, or the timeout elapses. returns the process exit code
+func (w *Waiter) Wait(parent context.Context) int {
+	ctx, cancel := context.WithTimeout(parent, w.Timeout)
+	defer cancel()
+
+	backoff := minBackoff
+	for {
+		code, done := w.poll(ctx)
+		if done {
+			return code
+		}
+
+		select {
+		case <-ctx.Done():
+			if parent.Err() != nil {
+				w.Logger.Println("ERROR wait interrupted")
+				return ExitInterrupted
+			}
+			w.Logger.Printf("ERROR targets not ready after %s", w.Timeout)
+			return ExitTimeout
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// make one status request, reporting the exit code if the wait is over
+func (w *Waiter) poll(ctx context.Context) (int, bool) {
+	req, err := http.NewRequest(http.MethodGet, w.statusURL(), nil)
+	if err != nil {
+		w.Logger.Printf("ERROR invalid whalewatcher URL %q: %s", w.URL, err)
+		return ExitError, true
+	}
+
+	resp, err := w.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == nil {
+			w.Logger.Printf("WARN whalewatcher not reachable yet: %s", err)
+		}
+		return 0, false
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		w.Logger.Printf("WARN failed to read status response: %s", err)
+		return 0, false
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		w.Logger.Printf("ERROR %s", body)
+		return ExitNotFound, true
+
+	case http.StatusOK, http.StatusAccepted, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		statuses := map[string]tailer.Status{}
+		if err := json.Unmarshal(body, &statuses); err != nil {
+			w.Logger.Printf("WARN failed to parse status response: %s", err)
+			return 0, false
+		}
+		w.report(statuses)
+
+	default:
+		w.Logger.Printf("WARN unexpected status %d from whalewatcher: %s", resp.StatusCode, body)
+		return 0, false
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		w.Logger.Println("INFO all targets ready")
+		return ExitReady, true
+	case http.StatusServiceUnavailable:
+		return ExitFailed, true
+	case http.StatusGatewayTimeout:
+		return ExitTimeout, true
+	}
+
+	return 0, false
+}
+
+// log each target whose state changed since the last poll
+func (w *Waiter) report(statuses map[string]tailer.Status) {
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		state := describe(statuses[name])
+		if w.seen[name] == state {
+			continue
+		}
+		w.seen[name] = state
+		w.Logger.Printf("INFO %s: %s", name, state)
+	}
+}
+
+func (w *Waiter) statusURL() string {
+	query := url.Values{}
+	if len(w.Targets) > 0 {
+		query.Set("status", strings.Join(w.Targets, ","))
+	}
+	if len(w.Groups) > 0 {
+		query.Set("group", strings.Join(w.Groups, ","))
+	}
+
+	if len(query) == 0 {
+		return w.URL + "/"
+	}
+	return fmt.Sprintf("%s/?%s", w.URL, query.Encode())
+}
+
+// summarize a target's status for progress output
+func describe(status tailer.Status) string {
+	state := string(status.Phase)
+	if len(state) == 0 {
+		switch {
+		case len(status.Error) > 0:
+			state = "failed"
+		case status.Ready:
+			state = "ready"
+		default:
+			state = "pending"
+		}
+	}
+
+	if len(status.Error) > 0 {
+		return fmt.Sprintf("%s (%s)", state, status.Error)
+	}
+	return state
+}
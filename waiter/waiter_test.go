@@ -0,0 +1,124 @@
+package waiter
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serves the supplied status responses in order, repeating the last one
+func statusServer(t *testing.T, responses ...func(w http.ResponseWriter)) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the handler runs off the test goroutine, where require can't stop the test
+		assert.Equal(t, "foo,bar", r.URL.Query().Get("status"))
+		n := int(atomic.AddInt32(&calls, 1)) - 1
+		if n >= len(responses) {
+			n = len(responses) - 1
+		}
+		responses[n](w)
+	}))
+	return srv, &calls
+}
+
+func respond(status int, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+func testWaiter(url string, timeout time.Duration) (*Waiter, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return New(url, []string{"foo", "bar"}, timeout, log.New(out, "", 0)), out
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	srv, calls := statusServer(t,
+		respond(202, `{"foo":{"ready":false,"error":"","phase":"streaming"},"bar":{"ready":false,"error":"","phase":"awaiting_container"}}`),
+		respond(202, `{"foo":{"ready":true,"error":"","phase":"ready"},"bar":{"ready":false,"error":"","phase":"awaiting_container"}}`),
+		respond(200, `{"foo":{"ready":true,"error":"","phase":"ready"},"bar":{"ready":true,"error":"","phase":"ready"}}`),
+	)
+	defer srv.Close()
+
+	w, out := testWaiter(srv.URL, 10*time.Second)
+	require.Equal(t, ExitReady, w.Wait(context.TODO()))
+	require.Equal(t, int32(3), atomic.LoadInt32(calls))
+
+	// progress is only reported when a target's state changes
+	require.Equal(t, 1, bytes.Count(out.Bytes(), []byte("bar: awaiting_container")))
+	require.Contains(t, out.String(), "foo: ready")
+	require.Contains(t, out.String(), "bar: ready")
+}
+
+func TestWaitFailed(t *testing.T) {
+	srv, _ := statusServer(t,
+		respond(503, `{"foo":{"ready":false,"error":"ouch","phase":"failed"},"bar":{"ready":true,"error":""}}`),
+	)
+	defer srv.Close()
+
+	w, out := testWaiter(srv.URL, 10*time.Second)
+	require.Equal(t, ExitFailed, w.Wait(context.TODO()))
+	require.Contains(t, out.String(), "foo: failed (ouch)")
+}
+
+func TestWaitNotFound(t *testing.T) {
+	srv, _ := statusServer(t, respond(404, "requested service (bar) is not registered"))
+	defer srv.Close()
+
+	w, _ := testWaiter(srv.URL, 10*time.Second)
+	require.Equal(t, ExitNotFound, w.Wait(context.TODO()))
+}
+
+func TestWaitTimeout(t *testing.T) {
+	srv, _ := statusServer(t, respond(202, `{"foo":{"ready":false,"error":""},"bar":{"ready":false,"error":""}}`))
+	defer srv.Close()
+
+	w, out := testWaiter(srv.URL, 100*time.Millisecond)
+	require.Equal(t, ExitTimeout, w.Wait(context.TODO()))
+	require.Contains(t, out.String(), "foo: pending")
+}
+
+func TestWaitRetriesUnreachableServer(t *testing.T) {
+	srv, _ := statusServer(t, respond(200, `{}`))
+	url := srv.URL
+	srv.Close()
+
+	w, out := testWaiter(url, 300*time.Millisecond)
+	require.Equal(t, ExitTimeout, w.Wait(context.TODO()))
+	require.Contains(t, out.String(), "not reachable yet")
+}
+
+func TestWaitInterrupted(t *testing.T) {
+	srv, _ := statusServer(t, respond(202, `{"foo":{"ready":false,"error":""},"bar":{"ready":false,"error":""}}`))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	w, _ := testWaiter(srv.URL, 10*time.Second)
+	require.Equal(t, ExitInterrupted, w.Wait(ctx))
+}
+
+func TestStatusURL(t *testing.T) {
+	w := New("http://whalewatcher:4444/", nil, time.Second, log.New(&bytes.Buffer{}, "", 0))
+	require.Equal(t, "http://whalewatcher:4444/", w.statusURL())
+
+	w.Targets = []string{"foo", "bar"}
+	require.Equal(t, "http://whalewatcher:4444/?status=foo%2Cbar", w.statusURL())
+
+	w.Groups = []string{"backend"}
+	require.Equal(t, "http://whalewatcher:4444/?group=backend&status=foo%2Cbar", w.statusURL())
+}